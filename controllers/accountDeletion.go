@@ -0,0 +1,280 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+)
+
+const defaultDeletionGraceDays = 30
+
+// deletionGracePeriod is how long a deleted account stays disabled (and can be
+// recovered by logging in) before it is anonymized. Set with ACCOUNT_DELETION_GRACE_DAYS.
+func deletionGracePeriod() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultDeletionGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DeleteUser schedules the deletion of the authenticated user's account. The account
+// is disabled right away; logging in again before the grace period ends cancels the
+// deletion, after it the account is anonymized by ProcessAccountDeletions.
+func DeleteUser(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	now := time.Now()
+	deleteAfter := now.Add(deletionGracePeriod())
+
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Updates(map[string]interface{}{
+			"deletion_requested_at": now,
+			"delete_after":          deleteAfter,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&models.AccountDeletion{
+			UserID:       CurrentUser.ID,
+			Status:       models.AccountDeletionScheduled,
+			RequestedAt:  now,
+			ScheduledFor: deleteAfter,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	// The account is disabled: drop its live connection
+	disconnectClient(CurrentUser.ID)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "Account scheduled for deletion, log in again before then to cancel",
+		"delete_after": deleteAfter,
+	})
+}
+
+// cancelAccountDeletion re-enables an account whose deletion was requested, because its
+// owner logged in during the grace period
+func cancelAccountDeletion(user *models.User) error {
+	now := time.Now()
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"deletion_requested_at": nil,
+			"delete_after":          nil,
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.AccountDeletion{}).
+			Where("user_id = ? AND status = ?", user.ID, models.AccountDeletionScheduled).
+			Updates(map[string]interface{}{"status": models.AccountDeletionCancelled, "cancelled_at": now}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	user.DeletionRequestedAt = nil
+	user.DeleteAfter = nil
+	return nil
+}
+
+// ProcessAccountDeletions anonymizes the accounts whose grace period is over
+func ProcessAccountDeletions() {
+	var users []models.User
+	if err := services.DB.
+		Where("delete_after <= ? AND anonymized_at IS NULL", time.Now()).
+		Find(&users).Error; err != nil {
+		fmt.Println("Failed to find accounts to delete:", err)
+		return
+	}
+
+	for _, user := range users {
+		if err := anonymizeUser(context.Background(), user); err != nil {
+			log.Printf("failed to delete account %s: %v", user.ID, err)
+		}
+	}
+
+	fmt.Printf("Successfully processed %d account deletions\n", len(users))
+}
+
+// anonymizeUser erases a user: their DMs are deleted, they leave their groups and their
+// profile becomes "Deleted user". The user row stays, so the messages they sent in
+// groups still have a sender, now anonymous.
+func anonymizeUser(ctx context.Context, user models.User) error {
+	audit := models.AccountDeletion{}
+
+	// Their sessions go first, so nothing can use the account while it is erased
+	if err := services.AuthClient.RevokeRefreshTokens(ctx, user.ID); err != nil {
+		log.Printf("failed to revoke sessions of deleted user %s: %v", user.ID, err)
+	} else {
+		audit.SessionsRevoked = true
+	}
+	disconnectClient(user.ID)
+
+	var dmChatIDs []uuid.UUID
+	if err := services.DB.
+		Model(&models.ChatUser{}).
+		Joins("JOIN chats ON chats.id = chat_users.chat_id").
+		Where("chat_users.user_id = ? AND chats.is_group = false", user.ID).
+		Pluck("chat_users.chat_id", &dmChatIDs).Error; err != nil {
+		return fmt.Errorf("failed to query DMs: %w", err)
+	}
+
+	var groups []models.ChatUser
+	if err := services.DB.
+		Joins("JOIN chats ON chats.id = chat_users.chat_id").
+		Where("chat_users.user_id = ? AND chats.is_group = true", user.ID).
+		Find(&groups).Error; err != nil {
+		return fmt.Errorf("failed to query groups: %w", err)
+	}
+
+	// The other members of the DMs, who have to sync the chats going away
+	var dmPartners []models.ChatUser
+	if len(dmChatIDs) > 0 {
+		if err := services.DB.
+			Select("chat_id, user_id").
+			Where("chat_id IN ? AND user_id <> ?", dmChatIDs, user.ID).
+			Find(&dmPartners).Error; err != nil {
+			return fmt.Errorf("failed to query DMs: %w", err)
+		}
+	}
+
+	var exports []models.ExportJob
+	if err := services.DB.Where("user_id = ? AND file_key <> ''", user.ID).Find(&exports).Error; err != nil {
+		return fmt.Errorf("failed to query exports: %w", err)
+	}
+
+	now := time.Now()
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if len(dmChatIDs) > 0 {
+			// Cascades to their messages and members
+			if err := tx.Where("id IN ?", dmChatIDs).Delete(&models.Chat{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.ChatUser{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Message{}).Where("sender_id = ?", user.ID).Count(&audit.MessagesAnonymized).Error; err != nil {
+			return err
+		}
+
+		// Everything else that links the user to other people
+		cleanups := []struct {
+			query string
+			model interface{}
+		}{
+			{"user_id = @id OR contact_id = @id", &models.Contact{}},
+			{"from_id = @id OR to_id = @id", &models.FriendRequest{}},
+			{"blocker_id = @id OR blocked_id = @id", &models.Block{}},
+			{"user_id = @id", &models.UsernameHistory{}},
+			{"user_id = @id", &models.JoinRequest{}},
+			{"user_id = @id", &models.ExportJob{}},
+			{"user_id = @id", &models.Device{}},
+			{"user_id = @id", &models.QuietSchedule{}},
+			{"user_id = @id", &models.DeferredPush{}},
+			{"owner_id = @id AND scope = 'private'", &models.TextFilter{}},
+		}
+		for _, cleanup := range cleanups {
+			if err := tx.Where(cleanup.query, map[string]interface{}{"id": user.ID}).Delete(cleanup.model).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"display_name":          "Deleted user",
+			"username":              "deleted_" + user.ID,
+			"email":                 user.ID + "@deleted.invalid",
+			"photo_url":             "",
+			"bio":                   "",
+			"last_seen":             nil,
+			"custom_display_name":   false,
+			"custom_photo":          false,
+			"contacts_only":         false,
+			"last_seen_visibility":  models.VisibilityNobody,
+			"online_visibility":     models.VisibilityNobody,
+			"photo_visibility":      models.VisibilityNobody,
+			"deletion_requested_at": nil,
+			"delete_after":          nil,
+			"anonymized_at":         now,
+		}).Error; err != nil {
+			return err
+		}
+
+		changes := []models.Change{userChange(user.ID, models.ChangeOpUpsert)}
+		for _, p := range dmPartners {
+			changes = append(changes, chatStateChange(p.ChatID, p.UserID, models.ChangeOpDelete))
+		}
+		for _, g := range groups {
+			changes = append(changes, memberChange(g.ChatID, user.ID, models.ChangeOpDelete))
+		}
+		if err := services.RecordChanges(tx, changes...); err != nil {
+			return err
+		}
+
+		audit.DMsDeleted = len(dmChatIDs)
+		audit.GroupsLeft = len(groups)
+		result := tx.Model(&models.AccountDeletion{}).
+			Where("user_id = ? AND status = ?", user.ID, models.AccountDeletionScheduled).
+			Updates(map[string]interface{}{
+				"status":              models.AccountDeletionCompleted,
+				"completed_at":        now,
+				"dms_deleted":         audit.DMsDeleted,
+				"groups_left":         audit.GroupsLeft,
+				"messages_anonymized": audit.MessagesAnonymized,
+				"sessions_revoked":    audit.SessionsRevoked,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Scheduled before audit records existed
+			audit.UserID = user.ID
+			audit.Status = models.AccountDeletionCompleted
+			audit.RequestedAt = now
+			if user.DeletionRequestedAt != nil {
+				audit.RequestedAt = *user.DeletionRequestedAt
+			}
+			audit.ScheduledFor = now
+			audit.CompletedAt = &now
+			return tx.Create(&audit).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Groups are never left without an owner
+	for _, g := range groups {
+		if g.Role == models.ChatRoleOwner {
+			if err := transferGroupOwnership(g.ChatID); err != nil {
+				log.Printf("failed to transfer ownership of group %s: %v", g.ChatID, err)
+			}
+		}
+	}
+
+	deleteStoredImages(ctx, user.PhotoURL, profilePhotoSizes)
+	for _, job := range exports {
+		if err := services.ExportStorage.Delete(ctx, job.FileKey); err != nil {
+			log.Printf("failed to delete export %s: %v", job.ID, err)
+		}
+	}
+
+	return nil
+}
@@ -1,13 +1,17 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
+	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/shogoshima/divertidachat-backend/models"
 	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
 )
 
 func Login(c *gin.Context) {
@@ -43,33 +47,40 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	// Upsert the user in one round-trip
 	var user models.User
-	result := services.DB.
-		WithContext(ctx).
-		Where(models.User{ID: userRecord.UID}).
-		// only set these fields on INSERT
-		Attrs(models.User{
-			DisplayName: userRecord.DisplayName,
-			Username:    strings.Split(userRecord.Email, "@")[0],
-			Email:       userRecord.Email,
-			PhotoURL:    userRecord.PhotoURL,
-		}).
-		FirstOrCreate(&user)
+	created := false
+	err = services.DB.WithContext(ctx).Where("id = ?", userRecord.UID).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user, err = createUser(ctx, userRecord)
+		created = true
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	if result.Error != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+	if user.AnonymizedAt != nil {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "This account was deleted"})
 		return
 	}
 
+	// Logging in during the grace period keeps the account
+	if user.DeletionRequestedAt != nil {
+		if err := cancelAccountDeletion(&user); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel account deletion"})
+			return
+		}
+	}
+
 	// If the record already existed, check for profile changes & save
-	if result.RowsAffected == 0 {
+	if !created {
 		changed := false
-		if user.DisplayName != userRecord.DisplayName {
+		// Fields the user edited themselves win over the provider's
+		if !user.CustomDisplayName && user.DisplayName != userRecord.DisplayName {
 			user.DisplayName = userRecord.DisplayName
 			changed = true
 		}
-		if user.PhotoURL != userRecord.PhotoURL {
+		if !user.CustomPhoto && user.PhotoURL != userRecord.PhotoURL {
 			user.PhotoURL = userRecord.PhotoURL
 			changed = true
 		}
@@ -78,6 +89,7 @@ func Login(c *gin.Context) {
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
+			recordChanges(userChange(user.ID, models.ChangeOpUpsert))
 		}
 	}
 
@@ -85,3 +97,33 @@ func Login(c *gin.Context) {
 		"profile": user,
 	})
 }
+
+// createUser creates the user who logs in for the first time, with a username made
+// from their email
+func createUser(ctx context.Context, userRecord *auth.UserRecord) (models.User, error) {
+	user := models.User{
+		ID:          userRecord.UID,
+		DisplayName: userRecord.DisplayName,
+		Email:       userRecord.Email,
+		PhotoURL:    userRecord.PhotoURL,
+	}
+
+	// Someone may take the username in the meantime, another one is picked then
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		user.Username, err = signupUsername(services.DB.WithContext(ctx), userRecord.Email, user.ID)
+		if err != nil {
+			return user, err
+		}
+		if err = services.DB.WithContext(ctx).Create(&user).Error; !isUniqueViolation(err) {
+			return user, err
+		}
+
+		// Or the user logged in twice at once
+		var existing models.User
+		if services.DB.WithContext(ctx).Where("id = ?", user.ID).First(&existing).Error == nil {
+			return existing, nil
+		}
+	}
+	return user, err
+}
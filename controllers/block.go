@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func GetBlockedUsers(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var blocked []models.User
+	if err := services.DB.
+		Select(profileColumns).
+		Joins("JOIN blocks ON blocks.blocked_id = users.id").
+		Where("blocks.blocker_id = ?", CurrentUser.ID).
+		Order("blocks.created_at DESC").
+		Find(&blocked).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch blocked users"})
+		return
+	}
+
+	viewer, err := newUsersViewer(CurrentUser, blocked)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch blocked users"})
+		return
+	}
+
+	profiles := make([]models.PublicProfile, 0, len(blocked))
+	for _, u := range blocked {
+		profiles = append(profiles, viewer.profile(u))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocked": profiles})
+}
+
+func BlockUser(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		Username string `json:"username" binding:"required"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	var target models.User
+	if err := findUser(body.Username, &target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if target.ID == CurrentUser.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot block yourself"})
+		return
+	}
+
+	// Blocking twice is fine. Blocking also ends the contact and any pending friend request.
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Block{
+			BlockerID: CurrentUser.ID,
+			BlockedID: target.ID,
+		}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.
+			Where("(user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)", CurrentUser.ID, target.ID, target.ID, CurrentUser.ID).
+			Delete(&models.Contact{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.
+			Where("((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?)) AND status = ?", CurrentUser.ID, target.ID, target.ID, CurrentUser.ID, models.FriendRequestPending).
+			Delete(&models.FriendRequest{}).Error; err != nil {
+			return err
+		}
+
+		// Both users see less of each other's profile now
+		return services.RecordChanges(tx,
+			userChange(CurrentUser.ID, models.ChangeOpUpsert),
+			userChange(target.ID, models.ChangeOpUpsert))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "User blocked successfully"})
+}
+
+func UnblockUser(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var removed []models.Block
+	result := services.DB.
+		Clauses(clause.Returning{}).
+		Where("blocker_id = ? AND blocked_id = (SELECT id FROM users WHERE username = ?)", CurrentUser.ID, c.Param("username")).
+		Delete(&removed)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not blocked"})
+		return
+	}
+
+	// Both users may see more of each other's profile again
+	for _, b := range removed {
+		recordChanges(userChange(b.BlockerID, models.ChangeOpUpsert), userChange(b.BlockedID, models.ChangeOpUpsert))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unblocked successfully"})
+}
+
+// isBlocked reports whether either user blocked the other
+func isBlocked(userID, otherID string) (bool, error) {
+	var count int64
+	err := services.DB.Model(&models.Block{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", userID, otherID, otherID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// anyBlocked reports whether a block exists, in either direction, between the user
+// and any of the others
+func anyBlocked(userID string, otherIDs []string) (bool, error) {
+	if len(otherIDs) == 0 {
+		return false, nil
+	}
+
+	var count int64
+	err := services.DB.Model(&models.Block{}).
+		Where("(blocker_id = ? AND blocked_id IN ?) OR (blocker_id IN ? AND blocked_id = ?)", userID, otherIDs, otherIDs, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// isDMBlocked reports whether the chat is a DM between the sender and someone they
+// blocked or who blocked them
+func isDMBlocked(chatID uuid.UUID, senderID string) (bool, error) {
+	var count int64
+	err := services.DB.
+		Table("chats").
+		Joins("JOIN chat_users other ON other.chat_id = chats.id AND other.user_id <> ?", senderID).
+		Joins("JOIN blocks ON (blocks.blocker_id = other.user_id AND blocks.blocked_id = ?) OR (blocks.blocker_id = ? AND blocks.blocked_id = other.user_id)", senderID, senderID).
+		Where("chats.id = ? AND chats.is_group = false", chatID).
+		Count(&count).Error
+	return count > 0, err
+}
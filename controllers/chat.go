@@ -1,9 +1,12 @@
 package controllers
 
 import (
+	"encoding/base64"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -12,106 +15,158 @@ import (
 	"gorm.io/gorm"
 )
 
+// chatSummaryRow is one row of chatSummaryQuery
+type chatSummaryRow struct {
+	ChatID      uuid.UUID
+	Name        string
+	IsGroup     bool
+	ChatPhoto   string
+	Description string
+	UpdatedAt   time.Time
+
+	models.ChatSettings
+	LastReadAt *time.Time
+
+	LastMessage         *string
+	LastMessageSenderID *string
+	LastMessageAt       *time.Time
+	LastMessageKind     *string
+
+	// The other participant, for DMs
+	OtherName  *string
+	OtherPhoto *string
+}
+
+// chatSummaryQuery builds, in a single query, the summaries of the chats the user
+// belongs to: chat info, the user's settings, the last message the user can see and,
+// for DMs, the other participant.
+func chatSummaryQuery(userID string) *gorm.DB {
+	return services.DB.
+		Table("chat_users cu").
+		Select(`chats.id AS chat_id, chats.name, chats.is_group, chats.chat_photo, chats.description, chats.updated_at,
+			cu.muted_until, cu.muted_forever, cu.pin_order, cu.archived, cu.keep_archived, cu.last_read_at,
+			lm.text AS last_message, lm.sender_id AS last_message_sender_id,
+			lm.sent_at AS last_message_at, lm.kind AS last_message_kind,
+			other.display_name AS other_name, other.photo AS other_photo`).
+		Joins("JOIN chats ON chats.id = cu.chat_id").
+		Joins(`LEFT JOIN LATERAL (
+			SELECT m.text, m.sender_id, m.sent_at, m.kind FROM messages m
+			WHERE m.chat_id = cu.chat_id AND (cu.cleared_at IS NULL OR m.sent_at > cu.cleared_at)
+			ORDER BY m.sent_at DESC
+			LIMIT 1
+		) lm ON true`).
+		Joins(`LEFT JOIN LATERAL (
+			SELECT u.display_name, `+visiblePhotoSQL("u", "cu.user_id")+` AS photo FROM chat_users ocu
+			JOIN users u ON u.id = ocu.user_id
+			WHERE ocu.chat_id = cu.chat_id AND ocu.user_id <> cu.user_id
+			LIMIT 1
+		) other ON chats.is_group = false`).
+		Where("cu.user_id = ?", userID)
+}
+
+func (row chatSummaryRow) toSummary() models.ChatSummary {
+	// If not a group, name = other participant's name
+	chatName, chatPhoto := row.Name, row.ChatPhoto
+	if !row.IsGroup && row.OtherName != nil {
+		chatName = *row.OtherName
+		chatPhoto = ""
+		if row.OtherPhoto != nil {
+			chatPhoto = *row.OtherPhoto
+		}
+	}
+
+	return models.ChatSummary{
+		ChatID:              row.ChatID,
+		ChatName:            chatName,
+		IsGroup:             row.IsGroup,
+		ChatPhoto:           chatPhoto,
+		Description:         row.Description,
+		LastMessage:         row.LastMessage,
+		LastMessageSenderID: row.LastMessageSenderID,
+		LastMessageAt:       row.LastMessageAt,
+		LastMessageKind:     row.LastMessageKind,
+		LastReadAt:          row.LastReadAt,
+		Settings:            row.ChatSettings,
+	}
+}
+
+const (
+	defaultChatPageSize = 50
+	maxChatPageSize     = 100
+)
+
+// GetChatSummaries lists the user's chats, most recently active first. The list is
+// paginated with an opaque cursor; pinned chats are all returned on the first page.
 func GetChatSummaries(c *gin.Context) {
 	user, _ := c.Get("currentUser")
 	CurrentUser := user.(models.User)
 
-	// Fetch chats that belong to this user
-	var chats []models.Chat
-	if err := services.DB.
-		Select("chats.id, chats.name, chats.is_group, chats.chat_photo").
-		Joins("JOIN chat_users ON chats.id = chat_users.chat_id").
-		Where("chat_users.user_id = ?", CurrentUser.ID).
-		Order("chats.updated_at DESC").
-		Find(&chats).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chats"})
-		return
+	// Archived chats are listed separately, with ?archived=true
+	archived := c.Query("archived") == "true"
+
+	limit := defaultChatPageSize
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxChatPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+			return
+		}
 	}
 
-	if len(chats) == 0 {
-		c.JSON(http.StatusOK, gin.H{"chats": []models.ChatSummary{}})
-		return
+	cursor := c.Query("cursor")
+	var after chatCursor
+	if cursor != "" {
+		var err error
+		if after, err = decodeChatCursor(cursor); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor parameter"})
+			return
+		}
 	}
 
-	chatIDs := make([]uuid.UUID, len(chats))
-	for i, chat := range chats {
-		chatIDs[i] = chat.ID
+	listed := func() *gorm.DB {
+		return chatSummaryQuery(CurrentUser.ID).
+			Where("cu.archived = ? AND cu.hidden = false", archived)
 	}
 
-	// Fetch all participants grouped by chat
-	type ChatParticipant struct {
-		ChatID      uuid.UUID
-		UserID      string
-		DisplayName string
-		Username    string
-		PhotoURL    string
+	var rows []chatSummaryRow
+	if cursor == "" {
+		if err := listed().
+			Where("cu.pin_order IS NOT NULL").
+			Order("cu.pin_order").
+			Scan(&rows).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chats"})
+			return
+		}
 	}
 
-	var rawParticipants []ChatParticipant
-	if err := services.DB.
-		Table("chat_users").
-		Select("chat_users.chat_id, users.id AS user_id, users.display_name, users.username, users.photo_url").
-		Joins("JOIN users ON users.id = chat_users.user_id").
-		Where("chat_users.chat_id IN ?", chatIDs).
-		Find(&rawParticipants).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch participants"})
+	var unpinned []chatSummaryRow
+	query := listed().Where("cu.pin_order IS NULL")
+	if cursor != "" {
+		query = query.Where("(chats.updated_at, chats.id) < (?, ?)", after.UpdatedAt, after.ChatID)
+	}
+	if err := query.
+		Order("chats.updated_at DESC, chats.id DESC").
+		Limit(limit).
+		Scan(&unpinned).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chats"})
 		return
 	}
+	rows = append(rows, unpinned...)
 
-	// Group by chatID
-	participantsByChat := make(map[uuid.UUID][]models.PublicProfile)
-	for _, p := range rawParticipants {
-		participantsByChat[p.ChatID] = append(participantsByChat[p.ChatID], models.PublicProfile{
-			ID:          p.UserID,
-			DisplayName: p.DisplayName,
-			Username:    p.Username,
-			PhotoURL:    p.PhotoURL,
-		})
+	chatSummaries := make([]models.ChatSummary, 0, len(rows))
+	for _, row := range rows {
+		chatSummaries = append(chatSummaries, row.toSummary())
 	}
 
-	var chatSummaries []models.ChatSummary
-	for _, chat := range chats {
-		participants := participantsByChat[chat.ID]
-
-		// If not a group, name = other participant's name
-		var chatPhoto string = chat.ChatPhoto
-		var chatName string = chat.Name
-		if !chat.IsGroup {
-			for _, p := range participants {
-				if p.ID != CurrentUser.ID {
-					chatName = p.DisplayName
-					chatPhoto = p.PhotoURL
-					break
-				}
-			}
-		}
-
-		// Fetch latest message for this chat
-		var message models.Message
-		if err := services.DB.
-			Where("chat_id = ?", chat.ID).
-			Order("sent_at DESC").
-			Limit(1).
-			First(&message).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
-			return
-		}
-
-		var lastMsg *string
-		if message.Text != "" {
-			lastMsg = &message.Text
-		}
-
-		chatSummaries = append(chatSummaries, models.ChatSummary{
-			ChatID:      chat.ID,
-			ChatName:    chatName,
-			IsGroup:     chat.IsGroup,
-			LastMessage: lastMsg,
-			ChatPhoto:   chatPhoto,
-		})
+	var nextCursor *string
+	if len(unpinned) == limit {
+		last := unpinned[len(unpinned)-1]
+		next := chatCursor{UpdatedAt: last.UpdatedAt, ChatID: last.ChatID}.encode()
+		nextCursor = &next
 	}
 
-	c.JSON(http.StatusOK, gin.H{"chats": chatSummaries})
+	c.JSON(http.StatusOK, gin.H{"chats": chatSummaries, "next_cursor": nextCursor})
 }
 
 func GetSingleChatSummary(c *gin.Context) {
@@ -125,67 +180,53 @@ func GetSingleChatSummary(c *gin.Context) {
 		return
 	}
 
-	// Ensure the user belongs to this chat
-	var chat models.Chat
-	if err := services.DB.
-		Select("id, name, is_group, chat_photo").
-		Where("id = ? AND EXISTS (SELECT 1 FROM chat_users WHERE chat_id = ? AND user_id = ?)",
-			chatID, chatID, CurrentUser.ID).
-		First(&chat).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or access denied"})
+	// Only returns a row if the user belongs to this chat
+	var rows []chatSummaryRow
+	if err := chatSummaryQuery(CurrentUser.ID).
+		Where("cu.chat_id = ?", chatID).
+		Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
 		return
 	}
-
-	// Get the participants
-	var participants []models.User
-	if err := services.DB.
-		Table("users").
-		Select("users.id", "users.display_name", "users.username", "users.photo_url").
-		Joins("JOIN chat_users ON chat_users.user_id = users.id").
-		Where("chat_users.chat_id = ?", chatID).
-		Find(&participants).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch participants"})
+	if len(rows) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or access denied"})
 		return
 	}
 
-	// If not a group, name = other participant's name
-	var chatPhoto string = chat.ChatPhoto
-	var chatName string = chat.Name
-	if !chat.IsGroup {
-		for _, p := range participants {
-			if p.ID != CurrentUser.ID {
-				chatName = p.DisplayName
-				chatPhoto = p.PhotoURL
-				break
-			}
-		}
-	}
+	c.JSON(http.StatusOK, gin.H{"chat": rows[0].toSummary()})
+}
 
-	// Fetch latest message for this chat
-	var message models.Message
-	if err := services.DB.
-		Where("chat_id = ?", chatID).
-		Order("sent_at DESC").
-		Limit(1).
-		First(&message).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
-		return
-	}
+// chatCursor is the position of the last chat of a page in the chat list
+type chatCursor struct {
+	UpdatedAt time.Time
+	ChatID    uuid.UUID
+}
 
-	var lastMsg *string
-	if message.Text != "" {
-		lastMsg = &message.Text
+func (cur chatCursor) encode() string {
+	raw := cur.UpdatedAt.UTC().Format(time.RFC3339Nano) + "|" + cur.ChatID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeChatCursor(s string) (chatCursor, error) {
+	var cur chatCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
 	}
 
-	chatSummary := models.ChatSummary{
-		ChatID:      chatID,
-		ChatName:    chatName,
-		IsGroup:     chat.IsGroup,
-		LastMessage: lastMsg,
-		ChatPhoto:   chatPhoto,
+	updatedAt, chatID, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return cur, errors.New("malformed cursor")
+	}
+	if cur.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt); err != nil {
+		return cur, err
+	}
+	if cur.ChatID, err = uuid.Parse(chatID); err != nil {
+		return cur, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{"chat": chatSummary})
+	return cur, nil
 }
 
 func GetChatDetails(c *gin.Context) {
@@ -210,11 +251,21 @@ func GetChatDetails(c *gin.Context) {
 		return
 	}
 
+	// Messages before the user cleared the history are not returned
+	var chatUser models.ChatUser
+	if err := services.DB.
+		Select("cleared_at").
+		Where("chat_id = ? AND user_id = ?", chatID, CurrentUser.ID).
+		First(&chatUser).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat settings"})
+		return
+	}
+
 	// Fetch participants (single query)
 	var participants []models.User
 	if err := services.DB.
 		Table("chat_users").
-		Select("users.id, users.display_name, users.username, users.photo_url").
+		Select(profileColumns).
 		Joins("JOIN users ON users.id = chat_users.user_id").
 		Where("chat_users.chat_id = ?", chat.ID).
 		Find(&participants).Error; err != nil {
@@ -222,15 +273,15 @@ func GetChatDetails(c *gin.Context) {
 		return
 	}
 
+	viewer, err := newUsersViewer(CurrentUser, participants)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch participants"})
+		return
+	}
+
 	var participantsPublicInfo []models.PublicProfile
 	for _, p := range participants {
-		participantsPublicInfo = append(participantsPublicInfo, models.PublicProfile{
-			ID:          p.ID,
-			DisplayName: p.DisplayName,
-			Username:    p.Username,
-			PhotoURL:    p.PhotoURL,
-			LastSeen:    p.LastSeen,
-		})
+		participantsPublicInfo = append(participantsPublicInfo, viewer.profile(p))
 	}
 
 	// Parse pagination params
@@ -246,7 +297,8 @@ func GetChatDetails(c *gin.Context) {
 	// Fetch paginated messages
 	var messages []models.Message
 	if err := services.DB.
-		Select("id, chat_id, sender_id, text, sent_at").
+		Select("id, chat_id, sender_id, text, kind, sent_at").
+		Scopes(visibleMessages(chatUser.ClearedAt)).
 		Where("chat_id = ?", chat.ID).
 		Order("sent_at DESC").
 		Limit(pageSize).
@@ -267,3 +319,43 @@ func GetChatDetails(c *gin.Context) {
 		},
 	})
 }
+
+// visibleMessages restricts a message query to the ones sent after the user
+// cleared the chat history, if they ever did.
+func visibleMessages(clearedAt *time.Time) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if clearedAt == nil {
+			return db
+		}
+		return db.Where("sent_at > ?", *clearedAt)
+	}
+}
+
+// ClearChatHistory hides every message currently in the chat from the current user.
+// Other members still see them.
+func ClearChatHistory(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	result := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ?", chatID, CurrentUser.ID).
+		Update("cleared_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear chat history"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or access denied"})
+		return
+	}
+
+	recordChanges(chatStateChange(chatID, CurrentUser.ID, models.ChangeOpUpsert))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chat history cleared successfully"})
+}
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+)
+
+// UpdateChatSettings changes the current user's mute, pin and archive settings for a chat.
+// Only the provided fields are updated.
+func UpdateChatSettings(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	type requestBody struct {
+		MuteForHours *int  `json:"mute_for_hours" binding:"omitempty,min=0"` // 0 unmutes
+		MuteForever  *bool `json:"mute_forever"`
+		Pinned       *bool `json:"pinned"`
+		Archived     *bool `json:"archived"`
+		KeepArchived *bool `json:"keep_archived"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	var chatUser models.ChatUser
+	if err := services.DB.Where("chat_id = ? AND user_id = ?", chatID, CurrentUser.ID).First(&chatUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or access denied"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	settings := &chatUser.ChatSettings
+
+	if body.MuteForHours != nil {
+		settings.MutedForever = false
+		settings.MutedUntil = nil
+		if *body.MuteForHours > 0 {
+			until := time.Now().Add(time.Duration(*body.MuteForHours) * time.Hour)
+			settings.MutedUntil = &until
+		}
+	}
+	if body.MuteForever != nil {
+		settings.MutedForever = *body.MuteForever
+		if settings.MutedForever {
+			settings.MutedUntil = nil
+		}
+	}
+
+	if body.Pinned != nil {
+		if !*body.Pinned {
+			settings.PinOrder = nil
+		} else if settings.PinOrder == nil {
+			// Pinning brings the chat back from the archive, unless archived below
+			settings.Archived = false
+
+			// Newly pinned chats go to the top
+			var minOrder sql.NullInt64
+			if err := services.DB.Model(&models.ChatUser{}).
+				Where("user_id = ? AND pin_order IS NOT NULL", CurrentUser.ID).
+				Select("MIN(pin_order)").
+				Scan(&minOrder).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			order := 0
+			if minOrder.Valid {
+				order = int(minOrder.Int64) - 1
+			}
+			settings.PinOrder = &order
+		}
+	}
+
+	if body.Archived != nil {
+		settings.Archived = *body.Archived
+		// Pinned chats make no sense in the archive
+		if settings.Archived {
+			settings.PinOrder = nil
+		}
+	}
+	if body.KeepArchived != nil {
+		settings.KeepArchived = *body.KeepArchived
+	}
+
+	if err := services.DB.Model(&chatUser).
+		Select("muted_until", "muted_forever", "pin_order", "archived", "keep_archived").
+		Updates(&chatUser).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat settings"})
+		return
+	}
+
+	recordChanges(chatStateChange(chatID, CurrentUser.ID, models.ChangeOpUpsert))
+
+	c.JSON(http.StatusOK, gin.H{"settings": chatUser.ChatSettings})
+}
+
+// ReorderPinnedChats sets the order of the current user's pinned chats to the given list.
+// Chats that are not in the list are unpinned.
+func ReorderPinnedChats(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		ChatIDs []uuid.UUID `json:"chat_ids"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		// Every chat pinned before or after changes position
+		var previouslyPinned []uuid.UUID
+		if err := tx.Model(&models.ChatUser{}).
+			Where("user_id = ? AND pin_order IS NOT NULL", CurrentUser.ID).
+			Pluck("chat_id", &previouslyPinned).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.ChatUser{}).
+			Where("user_id = ? AND pin_order IS NOT NULL", CurrentUser.ID).
+			Update("pin_order", nil).Error; err != nil {
+			return err
+		}
+
+		for i, chatID := range body.ChatIDs {
+			if err := tx.Model(&models.ChatUser{}).
+				Where("user_id = ? AND chat_id = ?", CurrentUser.ID, chatID).
+				Updates(map[string]interface{}{"pin_order": i, "archived": false}).Error; err != nil {
+				return err
+			}
+		}
+
+		changes := make([]models.Change, 0, len(previouslyPinned)+len(body.ChatIDs))
+		for _, chatID := range append(previouslyPinned, body.ChatIDs...) {
+			changes = append(changes, chatStateChange(chatID, CurrentUser.ID, models.ChangeOpUpsert))
+		}
+		return services.RecordChanges(tx, changes...)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder pinned chats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Pinned chats reordered successfully"})
+}
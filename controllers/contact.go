@@ -0,0 +1,367 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetContacts lists the current user's contacts, with whether they are online right now
+// (when their privacy settings allow it)
+func GetContacts(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var users []models.User
+	if err := services.DB.
+		Joins("JOIN contacts ON contacts.contact_id = users.id").
+		Where("contacts.user_id = ?", CurrentUser.ID).
+		Order("users.display_name").
+		Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+
+	viewer, err := newUsersViewer(CurrentUser, users)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch contacts"})
+		return
+	}
+
+	contacts := make([]models.ContactInfo, 0, len(users))
+	for _, u := range users {
+		contacts = append(contacts, models.ContactInfo{
+			PublicProfile: viewer.profile(u),
+			Online:        viewer.online(u),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"contacts": contacts})
+}
+
+func RemoveContact(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var other models.User
+	if err := services.DB.Where("username = ?", c.Param("username")).First(&other).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	result := services.DB.
+		Where("(user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)", CurrentUser.ID, other.ID, other.ID, CurrentUser.ID).
+		Delete(&models.Contact{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove contact"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a contact"})
+		return
+	}
+
+	recordChanges(userChange(CurrentUser.ID, models.ChangeOpUpsert), userChange(other.ID, models.ChangeOpUpsert))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Contact removed successfully"})
+}
+
+// SendFriendRequest asks another user to become a contact. If they already asked
+// the current user, both become contacts right away.
+func SendFriendRequest(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		Username string `json:"username" binding:"required"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	var target models.User
+	if err := findUser(body.Username, &target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if target.ID == CurrentUser.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot add yourself as a contact"})
+		return
+	}
+
+	blocked, err := isBlocked(CurrentUser.ID, target.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot add this user as a contact"})
+		return
+	}
+
+	contact, err := isContact(CurrentUser.ID, target.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if contact {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a contact"})
+		return
+	}
+
+	// The other user already asked: accept their request instead
+	var reverse models.FriendRequest
+	err = services.DB.
+		Where("from_id = ? AND to_id = ? AND status = ?", target.ID, CurrentUser.ID, models.FriendRequestPending).
+		First(&reverse).Error
+	if err == nil {
+		if err := acceptFriendRequest(&reverse); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept friend request"})
+			return
+		}
+		notifyFriendRequest(reverse, "friend_request_accepted", reverse.FromID)
+		c.JSON(http.StatusOK, gin.H{"request": reverse})
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	request := models.FriendRequest{
+		FromID: CurrentUser.ID,
+		ToID:   target.ID,
+		Status: models.FriendRequestPending,
+	}
+	result := services.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&request)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send friend request"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Friend request already sent"})
+		return
+	}
+
+	notifyFriendRequest(request, "friend_request", request.ToID)
+
+	c.JSON(http.StatusCreated, gin.H{"request": request})
+}
+
+// GetFriendRequests lists the pending requests the current user received and sent
+func GetFriendRequests(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var requests []models.FriendRequest
+	if err := services.DB.
+		Preload("From").
+		Preload("To").
+		Where("(from_id = ? OR to_id = ?) AND status = ?", CurrentUser.ID, CurrentUser.ID, models.FriendRequestPending).
+		Order("created_at DESC").
+		Find(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch friend requests"})
+		return
+	}
+
+	others := make([]string, 0, len(requests))
+	for _, r := range requests {
+		others = append(others, r.FromID, r.ToID)
+	}
+	viewer, err := newProfileViewer(CurrentUser, others)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch friend requests"})
+		return
+	}
+
+	incoming := []models.FriendRequestInfo{}
+	outgoing := []models.FriendRequestInfo{}
+	for _, r := range requests {
+		info := friendRequestInfo(viewer, r)
+		if r.ToID == CurrentUser.ID {
+			incoming = append(incoming, info)
+		} else {
+			outgoing = append(outgoing, info)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"incoming": incoming, "outgoing": outgoing})
+}
+
+func AcceptFriendRequest(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	request, ok := findPendingFriendRequest(c, "to_id", CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	if err := acceptFriendRequest(&request); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept friend request"})
+		return
+	}
+
+	notifyFriendRequest(request, "friend_request_accepted", request.FromID)
+
+	c.JSON(http.StatusOK, gin.H{"request": request})
+}
+
+func DeclineFriendRequest(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	request, ok := findPendingFriendRequest(c, "to_id", CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	request.Status = models.FriendRequestDeclined
+	request.RespondedAt = &now
+	if err := services.DB.Save(&request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decline friend request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request": request})
+}
+
+// CancelFriendRequest withdraws a request the current user sent
+func CancelFriendRequest(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	request, ok := findPendingFriendRequest(c, "from_id", CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	if err := services.DB.Delete(&request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel friend request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request cancelled successfully"})
+}
+
+// findPendingFriendRequest loads the pending request of the URL where column (from_id
+// or to_id) is the given user, answering the request when it doesn't exist.
+func findPendingFriendRequest(c *gin.Context, column string, userID string) (models.FriendRequest, bool) {
+	var request models.FriendRequest
+
+	requestID, err := uuid.Parse(c.Param("requestId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return request, false
+	}
+
+	if err := services.DB.
+		Where("id = ? AND status = ?", requestID, models.FriendRequestPending).
+		Where(clause.Eq{Column: clause.Column{Name: column}, Value: userID}).
+		First(&request).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Friend request not found"})
+			return request, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return request, false
+	}
+
+	return request, true
+}
+
+// acceptFriendRequest marks the request accepted and links both users as contacts
+func acceptFriendRequest(request *models.FriendRequest) error {
+	return services.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		request.Status = models.FriendRequestAccepted
+		request.RespondedAt = &now
+		if err := tx.Save(request).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&[]models.Contact{
+			{UserID: request.FromID, ContactID: request.ToID},
+			{UserID: request.ToID, ContactID: request.FromID},
+		}).Error; err != nil {
+			return err
+		}
+
+		// Privacy settings limited to contacts now let them see more of each other
+		return services.RecordChanges(tx,
+			userChange(request.FromID, models.ChangeOpUpsert),
+			userChange(request.ToID, models.ChangeOpUpsert))
+	})
+}
+
+// notifyFriendRequest tells the recipient about a friend request over WebSocket
+func notifyFriendRequest(request models.FriendRequest, eventType string, recipientID string) {
+	if err := services.DB.Preload("From").Preload("To").First(&request, "id = ?", request.ID).Error; err != nil {
+		return
+	}
+
+	// The profiles are seen by the recipient
+	recipient, other := request.To, request.From
+	if recipientID == request.FromID {
+		recipient, other = request.From, request.To
+	}
+	viewer, err := newProfileViewer(recipient, []string{other.ID})
+	if err != nil {
+		return
+	}
+
+	EventBroadcast <- Event{
+		Type:    eventType,
+		Data:    friendRequestInfo(viewer, request),
+		UserIDs: []string{recipientID},
+	}
+}
+
+func friendRequestInfo(viewer *profileViewer, r models.FriendRequest) models.FriendRequestInfo {
+	return models.FriendRequestInfo{
+		FriendRequest: r,
+		From:          viewer.profile(r.From),
+		To:            viewer.profile(r.To),
+	}
+}
+
+// isContact reports whether otherID is one of the user's contacts
+func isContact(userID, otherID string) (bool, error) {
+	var count int64
+	err := services.DB.Model(&models.Contact{}).
+		Where("user_id = ? AND contact_id = ?", userID, otherID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// contactsOnlyViolated reports whether any of the targets only accepts chats from
+// contacts and the user isn't one of them
+func contactsOnlyViolated(userID string, targets []models.User) (bool, error) {
+	var restricted []string
+	for _, t := range targets {
+		if t.ContactsOnly && t.ID != userID {
+			restricted = append(restricted, t.ID)
+		}
+	}
+	if len(restricted) == 0 {
+		return false, nil
+	}
+
+	var count int64
+	if err := services.DB.Model(&models.Contact{}).
+		Where("user_id IN ? AND contact_id = ?", restricted, userID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count < int64(len(restricted)), nil
+}
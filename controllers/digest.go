@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+const (
+	maxDigestChats    = 20 // Chats listed in a digest, those with mentions first
+	digestPreviewSize = 3  // Latest messages shown per chat
+	digestSendTimeout = 30 * time.Second
+)
+
+// digestChat is a chat with unread messages, as listed in a digest
+type digestChat struct {
+	ChatID   uuid.UUID
+	Name     string
+	IsGroup  bool
+	Unread   int
+	Mentions int
+	Muted    bool
+
+	Previews []digestPreview `gorm:"-"`
+}
+
+type digestPreview struct {
+	Sender string
+	Text   string
+}
+
+// digestData is what the digest templates are rendered from
+type digestData struct {
+	Name     string
+	Unread   int
+	Mentions int
+	Chats    []digestChat
+	Period   string
+}
+
+// SendEmailDigests emails, to the users who opted in and whose digest is due, a
+// summary of their unread messages and mentions per chat
+func SendEmailDigests() {
+	now := time.Now()
+
+	var users []models.User
+	if err := services.DB.
+		Where("digest_frequency <> ? AND deletion_requested_at IS NULL AND anonymized_at IS NULL", models.DigestOff).
+		Find(&users).Error; err != nil {
+		fmt.Println("Failed to find users for email digests:", err)
+		return
+	}
+
+	sent := 0
+	for _, user := range users {
+		period := user.DigestPeriod()
+		if period == 0 || (user.DigestSentAt != nil && now.Sub(*user.DigestSentAt) < period) {
+			continue
+		}
+
+		since := now.Add(-period)
+		if user.DigestSentAt != nil {
+			since = *user.DigestSentAt
+		}
+
+		ok, err := sendEmailDigest(user, since)
+		if err != nil {
+			// Tried again on the next run
+			fmt.Println("Failed to send email digest:", err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+
+		// Nothing unread counts as sent: the next digest covers what comes after
+		if err := services.DB.Model(&models.User{}).Where("id = ?", user.ID).Update("digest_sent_at", now).Error; err != nil {
+			fmt.Println("Failed to update digest time:", err)
+		}
+	}
+
+	fmt.Printf("Successfully sent %d email digests\n", sent)
+}
+
+// sendEmailDigest emails the user's digest of the messages since the given time, and
+// reports whether there was anything to tell
+func sendEmailDigest(user models.User, since time.Time) (bool, error) {
+	chats, err := digestChats(user, since)
+	if err != nil || len(chats) == 0 {
+		return false, err
+	}
+
+	data := digestData{Name: user.DisplayName, Chats: chats, Period: "today"}
+	if user.DigestFrequency == models.DigestWeekly {
+		data.Period = "this week"
+	}
+	for _, chat := range chats {
+		data.Unread += chat.Unread
+		data.Mentions += chat.Mentions
+	}
+
+	subject := fmt.Sprintf("You have %d unread messages", data.Unread)
+	if data.Unread == 1 {
+		subject = "You have 1 unread message"
+	}
+	if data.Mentions > 0 {
+		subject += fmt.Sprintf(" and %d mentions", data.Mentions)
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, data); err != nil {
+		return false, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, data); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), digestSendTimeout)
+	defer cancel()
+
+	return true, services.Mail.Send(ctx, services.Email{
+		To:      user.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	})
+}
+
+// digestChats counts, per chat, the messages the user hasn't read that were sent
+// after the given time, and how many mention them. Muted chats are only listed when
+// the user is mentioned. Unless the user hides message content, the latest messages
+// are previewed.
+func digestChats(user models.User, since time.Time) ([]digestChat, error) {
+	var chats []digestChat
+	err := services.DB.Raw(`
+		SELECT chats.id AS chat_id, chats.is_group,
+			CASE WHEN chats.is_group THEN chats.name ELSE (
+				SELECT u.display_name FROM chat_users o JOIN users u ON u.id = o.user_id
+				WHERE o.chat_id = chats.id AND o.user_id <> cu.user_id LIMIT 1
+			) END AS name,
+			COUNT(m.id) AS unread,
+			COUNT(m.id) FILTER (WHERE m.text ~* @mention) AS mentions,
+			(cu.muted_forever OR cu.muted_until > now()) AS muted
+		FROM chat_users cu
+		JOIN chats ON chats.id = cu.chat_id
+		JOIN messages m ON m.chat_id = cu.chat_id
+		WHERE cu.user_id = @user AND m.sender_id <> @user
+			AND m.sent_at > @since
+			AND (cu.last_read_at IS NULL OR m.sent_at > cu.last_read_at)
+			AND (cu.cleared_at IS NULL OR m.sent_at > cu.cleared_at)
+			AND NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.blocker_id = @user AND blocks.blocked_id = m.sender_id)
+		GROUP BY chats.id, chats.is_group, chats.name, cu.user_id, cu.muted_forever, cu.muted_until
+		ORDER BY mentions DESC, MAX(m.sent_at) DESC
+	`, map[string]interface{}{
+		"user":    user.ID,
+		"since":   since,
+		"mention": mentionPattern(user.Username),
+	}).Scan(&chats).Error
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make([]digestChat, 0, min(len(chats), maxDigestChats))
+	for _, chat := range chats {
+		if chat.Muted && chat.Mentions == 0 {
+			continue
+		}
+		if len(listed) == maxDigestChats {
+			break
+		}
+
+		if !user.HideContent {
+			if err := services.DB.
+				Table("messages m").
+				Select("u.display_name AS sender, m.text").
+				Joins("JOIN users u ON u.id = m.sender_id").
+				Joins("JOIN chat_users cu ON cu.chat_id = m.chat_id AND cu.user_id = ?", user.ID).
+				Where("m.chat_id = ? AND m.sender_id <> ? AND m.sent_at > ?", chat.ChatID, user.ID, since).
+				Where("(cu.last_read_at IS NULL OR m.sent_at > cu.last_read_at) AND (cu.cleared_at IS NULL OR m.sent_at > cu.cleared_at)").
+				Where("NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.blocker_id = ? AND blocks.blocked_id = m.sender_id)", user.ID).
+				Order("m.sent_at DESC").
+				Limit(digestPreviewSize).
+				Scan(&chat.Previews).Error; err != nil {
+				return nil, err
+			}
+		}
+		listed = append(listed, chat)
+	}
+	return listed, nil
+}
+
+var digestTextTemplate = texttemplate.Must(texttemplate.New("digest").Parse(
+	`Hi {{.Name}},
+
+You have {{.Unread}} unread messages{{if .Mentions}}, {{.Mentions}} of them mentioning you{{end}}, from {{.Period}}.
+{{range .Chats}}
+{{.Name}}: {{.Unread}} unread{{if .Mentions}}, {{.Mentions}} mentions{{end}}
+{{range .Previews}}  {{.Sender}}: {{.Text}}
+{{end}}{{end}}
+Open Divertida Chat to catch up. You can turn these emails off in the app's notification settings.
+`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Your unread messages</title></head>
+<body style="font-family: sans-serif; max-width: 600px; margin: 2em auto; color: #222;">
+<p>Hi {{.Name}},</p>
+<p>You have <b>{{.Unread}} unread messages</b>{{if .Mentions}}, {{.Mentions}} of them mentioning you{{end}}, from {{.Period}}.</p>
+{{range .Chats}}<div style="margin: 1em 0;">
+<h3 style="margin: 0;">{{.Name}}</h3>
+<p style="margin: .25em 0; color: #888;">{{.Unread}} unread{{if .Mentions}} · <b>{{.Mentions}} mentions</b>{{end}}</p>
+{{range .Previews}}<p style="margin: .25em 0;"><b>{{.Sender}}:</b> {{.Text}}</p>
+{{end}}</div>
+{{end}}<p style="color: #888; font-size: .85em;">Open Divertida Chat to catch up. You can turn these emails off in the app's notification settings.</p>
+</body></html>
+`))
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -34,18 +35,37 @@ func CreateSingleChat(c *gin.Context) {
 
 	// Get the target user
 	var targetUser models.User
-	if err := services.DB.Where("username = ?", body.Username).First(&targetUser).Error; err != nil {
+	if err := findUser(body.Username, &targetUser); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
+	// Nobody can start a chat across a block, in either direction
+	blocked, err := isBlocked(CurrentUser.ID, targetUser.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot start a chat with this user"})
+		return
+	}
+
+	// The chat shows the target's photo only if their privacy settings allow it
+	viewer, err := newProfileViewer(CurrentUser, []string{targetUser.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	targetProfile := viewer.profile(targetUser)
+
 	type ChatIDResult struct {
 		ChatID uuid.UUID `gorm:"column:chat_id"`
 	}
 
 	// Check if a chat between these two users already exists
 	var result ChatIDResult
-	err := services.DB.Raw(`
+	err = services.DB.Raw(`
 		SELECT cu1.chat_id FROM chat_users cu1 
 		JOIN chat_users cu2 ON cu1.chat_id = cu2.chat_id
 		JOIN chats ON chats.id = cu1.chat_id
@@ -55,6 +75,25 @@ func CreateSingleChat(c *gin.Context) {
 	fmt.Println("chatID after query: ", result.ChatID)
 
 	if err == nil && result.ChatID != uuid.Nil {
+		// A DM the user deleted for themselves comes back instead of being recreated
+		restored := services.DB.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ? AND hidden = true", result.ChatID, CurrentUser.ID).
+			Update("hidden", false)
+		if restored.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if restored.RowsAffected > 0 {
+			recordChanges(chatStateChange(result.ChatID, CurrentUser.ID, models.ChangeOpUpsert))
+			c.JSON(http.StatusOK, gin.H{"chat": models.ChatSummary{
+				ChatID:    result.ChatID,
+				IsGroup:   false,
+				ChatName:  targetUser.DisplayName,
+				ChatPhoto: targetProfile.PhotoURL,
+			}})
+			return
+		}
+
 		c.JSON(http.StatusConflict, gin.H{"error": "Chat already exists"})
 		return
 	}
@@ -64,6 +103,17 @@ func CreateSingleChat(c *gin.Context) {
 		return
 	}
 
+	// Users who only accept contacts can't get new DMs from strangers
+	restricted, err := contactsOnlyViolated(CurrentUser.ID, []models.User{targetUser})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if restricted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This user only accepts chats from contacts"})
+		return
+	}
+
 	// Create a new chat
 	newChat := models.Chat{IsGroup: false}
 	if err := services.DB.Create(&newChat).Error; err != nil {
@@ -81,13 +131,49 @@ func CreateSingleChat(c *gin.Context) {
 		return
 	}
 
+	recordChanges(chatChange(newChat.ID))
+
 	// Create Chat Details to return to user
 	summary := models.ChatSummary{
 		ChatID:    newChat.ID,
 		IsGroup:   newChat.IsGroup,
 		ChatName:  targetUser.DisplayName,
-		ChatPhoto: targetUser.PhotoURL,
+		ChatPhoto: targetProfile.PhotoURL,
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"chat": summary})
 }
+
+// DeleteSingleChat deletes a DM for the current user only: its history is cleared and
+// it disappears from the chat list until a new message arrives.
+func DeleteSingleChat(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	result := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ?", chatID, CurrentUser.ID).
+		Where("EXISTS (SELECT 1 FROM chats WHERE chats.id = chat_users.chat_id AND chats.is_group = false)").
+		Updates(map[string]interface{}{
+			"hidden":     true,
+			"cleared_at": time.Now(),
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete chat"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found or access denied"})
+		return
+	}
+
+	// The DM leaves the user's chat list until it gets a new message
+	recordChanges(chatStateChange(chatID, CurrentUser.ID, models.ChangeOpDelete))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Chat deleted successfully"})
+}
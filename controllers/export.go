@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+)
+
+const (
+	exportLinkTTL  = 7 * 24 * time.Hour // How long a finished export can be downloaded
+	exportCooldown = 24 * time.Hour     // Minimum time between two exports of the same user
+)
+
+var exportQueue = make(chan uuid.UUID, 100) // Export jobs waiting for the worker
+
+// exportJobInfo is an export job with its download link once it is ready
+type exportJobInfo struct {
+	models.ExportJob
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func newExportJobInfo(job models.ExportJob) exportJobInfo {
+	info := exportJobInfo{ExportJob: job}
+	if job.Status == models.ExportDone {
+		info.DownloadURL = fmt.Sprintf("/exports/%s?token=%s", job.ID, job.Token)
+	}
+	return info
+}
+
+// RequestDataExport starts building an archive with the authenticated user's data.
+// The archive is built in the background; poll GetDataExport until it is done.
+func RequestDataExport(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		IncludeDMs bool `json:"include_dms"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	var last models.ExportJob
+	err := services.DB.Where("user_id = ?", CurrentUser.ID).Order("created_at DESC").First(&last).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err == nil {
+		if last.Status == models.ExportPending || last.Status == models.ExportRunning {
+			c.JSON(http.StatusConflict, gin.H{"error": "An export is already in progress", "export": newExportJobInfo(last)})
+			return
+		}
+		if last.Status != models.ExportFailed && time.Since(last.CreatedAt) < exportCooldown {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "You can only export your data once a day", "export": newExportJobInfo(last)})
+			return
+		}
+	}
+
+	job := models.ExportJob{
+		UserID:     CurrentUser.ID,
+		Status:     models.ExportPending,
+		IncludeDMs: body.IncludeDMs,
+	}
+	if err := services.DB.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export"})
+		return
+	}
+
+	go func() { exportQueue <- job.ID }()
+
+	c.JSON(http.StatusAccepted, gin.H{"export": newExportJobInfo(job)})
+}
+
+// GetDataExport returns the state of one of the authenticated user's exports
+func GetDataExport(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	jobID, err := uuid.Parse(c.Param("exportId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export ID"})
+		return
+	}
+
+	var job models.ExportJob
+	if err := services.DB.Where("id = ? AND user_id = ?", jobID, CurrentUser.ID).First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"export": newExportJobInfo(job)})
+}
+
+// DownloadDataExport sends the archive of a finished export. It is reached through the
+// link given by GetDataExport, whose token replaces authentication (so browsers can
+// download it directly), until the export expires.
+func DownloadDataExport(c *gin.Context) {
+	jobID, err := uuid.Parse(c.Param("exportId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	var job models.ExportJob
+	if err := services.DB.Where("id = ? AND status = ?", jobID, models.ExportDone).First(&job).Error; err != nil ||
+		subtle.ConstantTimeCompare([]byte(job.Token), []byte(c.Query("token"))) != 1 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if job.ExpiresAt == nil || time.Now().After(*job.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "This export has expired"})
+		return
+	}
+
+	file, err := services.ExportStorage.Open(c.Request.Context(), job.FileKey)
+	if err != nil {
+		log.Printf("failed to open export %s: %v", job.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read export"})
+		return
+	}
+	defer file.Close()
+
+	c.DataFromReader(http.StatusOK, job.Size, "application/zip", file, map[string]string{
+		"Content-Disposition": `attachment; filename="divertidachat-export.zip"`,
+	})
+}
+
+// HandleExports builds queued exports one at a time. Exports interrupted by a restart
+// are started over.
+func HandleExports() {
+	if err := services.DB.Model(&models.ExportJob{}).
+		Where("status = ?", models.ExportRunning).
+		Update("status", models.ExportPending).Error; err != nil {
+		fmt.Println("Failed to reset interrupted exports:", err)
+	}
+
+	var pending []uuid.UUID
+	if err := services.DB.Model(&models.ExportJob{}).
+		Where("status = ?", models.ExportPending).
+		Order("created_at").
+		Pluck("id", &pending).Error; err != nil {
+		fmt.Println("Failed to load pending exports:", err)
+	}
+	for _, id := range pending {
+		runExportJob(id)
+	}
+
+	for id := range exportQueue {
+		runExportJob(id)
+	}
+}
+
+func runExportJob(id uuid.UUID) {
+	// Claim the job, so a job queued twice only runs once
+	claim := services.DB.Model(&models.ExportJob{}).
+		Where("id = ? AND status = ?", id, models.ExportPending).
+		Update("status", models.ExportRunning)
+	if claim.Error != nil || claim.RowsAffected == 0 {
+		return
+	}
+
+	var job models.ExportJob
+	if err := services.DB.Preload("User").First(&job, "id = ?", id).Error; err != nil {
+		fmt.Println("Failed to load export job:", err)
+		return
+	}
+
+	ctx := context.Background()
+	key, size, err := buildExport(ctx, job)
+	now := time.Now()
+	if err != nil {
+		log.Printf("export %s failed: %v", job.ID, err)
+		services.DB.Model(&job).Updates(map[string]interface{}{
+			"status":      models.ExportFailed,
+			"error":       "The export could not be built, please try again",
+			"finished_at": now,
+		})
+		return
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("export %s failed: %v", job.ID, err)
+		services.ExportStorage.Delete(ctx, key)
+		services.DB.Model(&job).Updates(map[string]interface{}{"status": models.ExportFailed, "finished_at": now})
+		return
+	}
+
+	if err := services.DB.Model(&job).Updates(map[string]interface{}{
+		"status":      models.ExportDone,
+		"file_key":    key,
+		"token":       hex.EncodeToString(token),
+		"size":        size,
+		"finished_at": now,
+		"expires_at":  now.Add(exportLinkTTL),
+	}).Error; err != nil {
+		log.Printf("failed to save export %s: %v", job.ID, err)
+		services.ExportStorage.Delete(ctx, key)
+		return
+	}
+
+	EventBroadcast <- Event{
+		Type:    "export_ready",
+		Data:    gin.H{"export_id": job.ID},
+		UserIDs: []string{job.UserID},
+	}
+}
+
+// buildExport writes the archive of the job to a temporary file, then moves it into
+// the export storage. It returns the storage key and size of the archive.
+func buildExport(ctx context.Context, job models.ExportJob) (string, int64, error) {
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeExportArchive(ctx, tmp, job); err != nil {
+		return "", 0, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	key := fmt.Sprintf("%s/%s.zip", job.UserID, job.ID)
+	if _, err := services.ExportStorage.Put(ctx, key, tmp, "application/zip"); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// PruneExports deletes the archives of expired exports
+func PruneExports() {
+	var jobs []models.ExportJob
+	if err := services.DB.
+		Where("status = ? AND expires_at < ?", models.ExportDone, time.Now()).
+		Find(&jobs).Error; err != nil {
+		fmt.Println("Failed to find expired exports:", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if err := services.ExportStorage.Delete(context.Background(), job.FileKey); err != nil {
+			fmt.Println("Failed to delete export:", err)
+			continue
+		}
+		services.DB.Model(&job).Updates(map[string]interface{}{"status": models.ExportExpired, "file_key": "", "token": ""})
+	}
+
+	fmt.Println("Successfully pruned expired exports")
+}
@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+// The archive contains:
+//
+//	profile.json             the user's profile and settings
+//	chats.json               the chats the user is in, with their participants
+//	messages/<chat id>.json  the messages exported from each chat
+//	index.html, chats/*.html the same, readable in a browser
+//	attachments/             the user's photo and the photos of their groups
+//
+// Messages are the user's own, plus everybody's in DMs when the job asks for it.
+// Messages hidden by clearing a chat's history are left out.
+
+const exportMessageBatchSize = 1000
+
+type exportProfile struct {
+	models.PublicProfile
+	Email   string                 `json:"email"`
+	Privacy models.PrivacySettings `json:"privacy"`
+	Photo   string                 `json:"photo,omitempty"` // Path in the archive
+}
+
+type exportParticipant struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Username    string `json:"username"`
+}
+
+type exportChat struct {
+	ID           uuid.UUID           `json:"id"`
+	Name         string              `json:"name"`
+	IsGroup      bool                `json:"is_group"`
+	Description  string              `json:"description,omitempty"`
+	Role         string              `json:"role,omitempty"`
+	JoinedAt     time.Time           `json:"joined_at"`
+	Photo        string              `json:"photo,omitempty"` // Path in the archive
+	Participants []exportParticipant `json:"participants"`
+	Messages     string              `json:"messages"` // Path in the archive
+	AllMessages  bool                `json:"all_messages"`
+
+	clearedAt *time.Time
+	names     map[string]string // Display names by user ID, for the HTML view
+}
+
+type exportMessage struct {
+	ID       uuid.UUID `json:"id"`
+	SenderID string    `json:"sender_id"`
+	Text     string    `json:"text"`
+	Kind     string    `json:"kind"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+func writeExportArchive(ctx context.Context, w io.Writer, job models.ExportJob) error {
+	zw := zip.NewWriter(w)
+	user := job.User
+
+	profile := exportProfile{
+		PublicProfile: ownProfile(user),
+		Email:         user.Email,
+		Privacy:       user.PrivacySettings,
+	}
+	if ok, err := copyAttachment(ctx, zw, user.PhotoURL, "attachments/profile.jpg"); err != nil {
+		return err
+	} else if ok {
+		profile.Photo = "attachments/profile.jpg"
+	}
+	if err := writeJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	chats, err := loadExportChats(user.ID, job.IncludeDMs)
+	if err != nil {
+		return err
+	}
+	for i := range chats {
+		chat := &chats[i]
+		if chat.IsGroup {
+			var photo string
+			services.DB.Model(&models.Chat{}).Where("id = ?", chat.ID).Pluck("chat_photo", &photo)
+			path := fmt.Sprintf("attachments/chats/%s.jpg", chat.ID)
+			if ok, err := copyAttachment(ctx, zw, photo, path); err != nil {
+				return err
+			} else if ok {
+				chat.Photo = path
+			}
+		}
+	}
+	if err := writeJSON(zw, "chats.json", chats); err != nil {
+		return err
+	}
+
+	for _, chat := range chats {
+		if err := writeChatMessages(zw, user.ID, chat); err != nil {
+			return err
+		}
+	}
+
+	if err := writeHTMLIndex(zw, profile, chats); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// loadExportChats lists the chats of the user with their participants
+func loadExportChats(userID string, includeDMs bool) ([]exportChat, error) {
+	type chatRow struct {
+		models.Chat
+		Role      string
+		JoinedAt  time.Time
+		ClearedAt *time.Time
+	}
+	var rows []chatRow
+	if err := services.DB.
+		Table("chat_users cu").
+		Select("chats.id, chats.name, chats.is_group, chats.description, cu.role, cu.joined_at, cu.cleared_at").
+		Joins("JOIN chats ON chats.id = cu.chat_id").
+		Where("cu.user_id = ?", userID).
+		Order("cu.joined_at").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load chats: %w", err)
+	}
+
+	chats := make([]exportChat, 0, len(rows))
+	for _, row := range rows {
+		var participants []exportParticipant
+		if err := services.DB.
+			Table("chat_users").
+			Select("users.id, users.display_name, users.username").
+			Joins("JOIN users ON users.id = chat_users.user_id").
+			Where("chat_users.chat_id = ?", row.ID).
+			Scan(&participants).Error; err != nil {
+			return nil, fmt.Errorf("failed to load participants: %w", err)
+		}
+
+		chat := exportChat{
+			ID:           row.ID,
+			Name:         row.Name,
+			IsGroup:      row.IsGroup,
+			Description:  row.Description,
+			JoinedAt:     row.JoinedAt,
+			Participants: participants,
+			Messages:     fmt.Sprintf("messages/%s.json", row.ID),
+			AllMessages:  !row.IsGroup && includeDMs,
+			clearedAt:    row.ClearedAt,
+			names:        make(map[string]string, len(participants)),
+		}
+		if row.IsGroup {
+			chat.Role = row.Role
+		}
+		for _, p := range participants {
+			chat.names[p.ID] = p.DisplayName
+			// DMs are named after the other participant
+			if !row.IsGroup && p.ID != userID {
+				chat.Name = p.DisplayName
+			}
+		}
+		chats = append(chats, chat)
+	}
+
+	return chats, nil
+}
+
+// eachExportMessage calls fn with the exported messages of the chat in order, loading
+// them in batches so big chats don't have to fit in memory
+func eachExportMessage(userID string, chat exportChat, fn func(exportMessage) error) error {
+	var after *exportMessage
+	for {
+		query := services.DB.Model(&models.Message{}).
+			Select("id, sender_id, text, kind, sent_at").
+			Scopes(visibleMessages(chat.clearedAt)).
+			Where("chat_id = ?", chat.ID)
+		if !chat.AllMessages {
+			query = query.Where("sender_id = ?", userID)
+		}
+		if after != nil {
+			query = query.Where("(sent_at, id) > (?, ?)", after.SentAt, after.ID)
+		}
+
+		var batch []exportMessage
+		if err := query.Order("sent_at, id").Limit(exportMessageBatchSize).Scan(&batch).Error; err != nil {
+			return fmt.Errorf("failed to load messages: %w", err)
+		}
+
+		for _, m := range batch {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportMessageBatchSize {
+			return nil
+		}
+		after = &batch[len(batch)-1]
+	}
+}
+
+// writeChatMessages writes the JSON and HTML files with the messages of a chat
+func writeChatMessages(zw *zip.Writer, userID string, chat exportChat) error {
+	f, err := zw.Create(chat.Messages)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "[\n"); err != nil {
+		return err
+	}
+	first := true
+	err = eachExportMessage(userID, chat, func(m exportMessage) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(f, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = f.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, "\n]\n"); err != nil {
+		return err
+	}
+
+	// Second pass for the HTML view, zip entries are written one at a time
+	h, err := zw.Create(fmt.Sprintf("chats/%s.html", chat.ID))
+	if err != nil {
+		return err
+	}
+	if err := exportTemplates.ExecuteTemplate(h, "chat_header", chat); err != nil {
+		return err
+	}
+	err = eachExportMessage(userID, chat, func(m exportMessage) error {
+		sender := chat.names[m.SenderID]
+		if sender == "" {
+			sender = "Deleted user"
+		}
+		return exportTemplates.ExecuteTemplate(h, "message", gin.H{
+			"Sender": sender,
+			"Text":   m.Text,
+			"SentAt": m.SentAt.UTC().Format("2006-01-02 15:04"),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return exportTemplates.ExecuteTemplate(h, "chat_footer", nil)
+}
+
+func writeHTMLIndex(zw *zip.Writer, profile exportProfile, chats []exportChat) error {
+	f, err := zw.Create("index.html")
+	if err != nil {
+		return err
+	}
+	return exportTemplates.ExecuteTemplate(f, "index", gin.H{"Profile": profile, "Chats": chats})
+}
+
+// copyAttachment copies a file of our storage into the archive. URLs of other hosts
+// (e.g. the auth provider's photos) are skipped.
+func copyAttachment(ctx context.Context, zw *zip.Writer, url string, path string) (bool, error) {
+	key, ok := services.FileStorage.KeyFromURL(url)
+	if !ok {
+		return false, nil
+	}
+
+	r, err := services.FileStorage.Open(ctx, key)
+	if err != nil {
+		// A missing file shouldn't fail the whole export
+		return false, nil
+	}
+	defer r.Close()
+
+	// Images are already compressed
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: path, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func writeJSON(zw *zip.Writer, path string, v any) error {
+	f, err := zw.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var exportTemplates = template.Must(template.New("export").Parse(`
+{{define "style"}}<style>
+body { font-family: sans-serif; max-width: 720px; margin: 2em auto; color: #222; }
+.message { margin: .5em 0; } .meta { color: #888; font-size: .85em; }
+.text { white-space: pre-wrap; } img { border-radius: 50%; }
+</style>{{end}}
+
+{{define "index"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Your Divertida Chat data</title>{{template "style"}}</head>
+<body>
+<h1>{{.Profile.DisplayName}}</h1>
+{{if .Profile.Photo}}<img src="{{.Profile.Photo}}" width="128" height="128" alt="">{{end}}
+<p>@{{.Profile.Username}} · {{.Profile.Email}}</p>
+{{if .Profile.Bio}}<p>{{.Profile.Bio}}</p>{{end}}
+<h2>Chats</h2>
+<ul>
+{{range .Chats}}<li><a href="chats/{{.ID}}.html">{{if .Name}}{{.Name}}{{else}}Unnamed chat{{end}}</a>{{if .IsGroup}} (group){{end}}</li>
+{{end}}</ul>
+</body></html>
+{{end}}
+
+{{define "chat_header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Name}}</title>{{template "style"}}</head>
+<body>
+<p><a href="../index.html">Back</a></p>
+<h1>{{.Name}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{if not .AllMessages}}<p class="meta">Only your own messages are included.</p>{{end}}
+{{end}}
+
+{{define "message"}}<div class="message"><div class="meta">{{.Sender}} · {{.SentAt}} UTC</div><div class="text">{{.Text}}</div></div>
+{{end}}
+
+{{define "chat_footer"}}</body></html>
+{{end}}
+`))
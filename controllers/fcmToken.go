@@ -1,46 +1,179 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"time"
 
+	"firebase.google.com/go/v4/messaging"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/shogoshima/divertidachat-backend/models"
 	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm/clause"
 )
 
+// UpdateFCMToken registers the device the token belongs to, or refreshes it.
+// A token that belonged to another account (someone else logged in on the same
+// phone before) moves to the current user.
 func UpdateFCMToken(c *gin.Context) {
 	user, _ := c.Get("currentUser")
 	CurrentUser := user.(models.User)
 
 	var fcmToken models.FCMToken
-
-	if err := c.BindJSON(&fcmToken); err != nil {
+	if err := c.ShouldBindJSON(&fcmToken); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "FCM Token not provided"})
+		return
+	}
+	if fcmToken.Platform == "" {
+		fcmToken.Platform = models.PlatformUnknown
+	}
+	if !models.ValidPlatform(fcmToken.Platform) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid platform, must be android, ios or web"})
+		return
 	}
 
-	err := services.DB.Model(&models.User{}).
-		Where("id = ?", CurrentUser.ID).
-		UpdateColumn("fcm_token", fcmToken.Token).Error
+	device := models.Device{
+		UserID:       CurrentUser.ID,
+		Token:        fcmToken.Token,
+		Platform:     fcmToken.Platform,
+		AppVersion:   fcmToken.AppVersion,
+		Name:         fcmToken.Name,
+		LastActiveAt: time.Now(),
+	}
+	err := services.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "platform", "app_version", "name", "last_active_at"}),
+	}).Create(&device).Error
 	if err != nil {
 		fmt.Println("Failed to update fcm token", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update token"})
+		return
 	}
-	fmt.Println("Token updated successfully")
 
-	c.JSON(http.StatusOK, gin.H{"message": "Token updated successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Token updated successfully", "device": device})
 }
 
+// DeleteFCMToken unregisters the device with the given token (?token=, or in a JSON
+// body), e.g. when logging out. Older apps send no token at all: every device of the
+// user is unregistered then, as when there was a single token per user.
 func DeleteFCMToken(c *gin.Context) {
 	user, _ := c.Get("currentUser")
 	CurrentUser := user.(models.User)
 
-	err := services.DB.Model(&models.User{}).
-		Where("id = ?", CurrentUser.ID).
-		UpdateColumn("fcm_token", nil).Error
+	type requestBody struct {
+		Token string `json:"fcm_token"`
+	}
+	body := requestBody{Token: c.Query("token")}
+	if body.Token == "" {
+		if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+			return
+		}
+	}
+
+	query := services.DB.Where("user_id = ?", CurrentUser.ID)
+	if body.Token != "" {
+		query = query.Where("token = ?", body.Token)
+	}
+	err := query.Delete(&models.Device{}).Error
 	if err != nil {
 		fmt.Println("Failed to delete fcm token", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token deleted successfully"})
+}
+
+// GetDevices lists the devices the authenticated user is signed in on
+func GetDevices(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	devices := []models.Device{}
+	if err := services.DB.
+		Where("user_id = ?", CurrentUser.ID).
+		Order("last_active_at DESC").
+		Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+// SignOutDevice signs one of the user's devices out remotely: it stops receiving
+// notifications and is told to sign out
+func SignOutDevice(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	deviceID, err := uuid.Parse(c.Param("deviceId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device ID"})
+		return
+	}
+
+	var devices []models.Device
+	result := services.DB.
+		Clauses(clause.Returning{}).
+		Where("id = ? AND user_id = ?", deviceID, CurrentUser.ID).
+		Delete(&devices)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out device"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	sendSignOut(c, devices)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device signed out successfully"})
+}
+
+// SignOutEverywhere revokes every session of the user and signs all their devices out,
+// the current one included
+func SignOutEverywhere(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	if err := services.AuthClient.RevokeRefreshTokens(c.Request.Context(), CurrentUser.ID); err != nil {
+		log.Printf("failed to revoke sessions of user %s: %v", CurrentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	var devices []models.Device
+	if err := services.DB.
+		Clauses(clause.Returning{}).
+		Where("user_id = ?", CurrentUser.ID).
+		Delete(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out devices"})
+		return
 	}
-	fmt.Println("Token updated successfully")
 
-	c.JSON(http.StatusOK, gin.H{"message": "Token updated successfully"})
+	sendSignOut(c, devices)
+	disconnectClient(CurrentUser.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out of every device"})
+}
+
+// sendSignOut tells the apps on the devices to sign out with a data-only push.
+// It is best effort: a device that misses it can't get notifications anymore anyway.
+func sendSignOut(c *gin.Context, devices []models.Device) {
+	for _, device := range devices {
+		err := services.Push.Send(c.Request.Context(), &messaging.Message{
+			Data:  map[string]string{"type": "sign_out"},
+			Token: device.Token,
+		})
+		if err != nil {
+			log.Printf("failed to send sign out to device %s: %v", device.ID, err)
+		}
+	}
 }
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"errors"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -9,6 +10,7 @@ import (
 	"github.com/shogoshima/divertidachat-backend/models"
 	"github.com/shogoshima/divertidachat-backend/services"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func CreateGroupChat(c *gin.Context) {
@@ -17,8 +19,9 @@ func CreateGroupChat(c *gin.Context) {
 
 	// Parse request body
 	type requestBody struct {
-		Name      string   `json:"name" binding:"required"`
-		Usernames []string `json:"usernames" binding:"required,min=1"`
+		Name        string   `json:"name" binding:"required"`
+		Description string   `json:"description" binding:"max=500"`
+		Usernames   []string `json:"usernames" binding:"required,min=1"`
 	}
 	var body requestBody
 	if err := c.ShouldBindJSON(&body); err != nil {
@@ -44,11 +47,32 @@ func CreateGroupChat(c *gin.Context) {
 		return
 	}
 
+	blocked, err := anyBlocked(CurrentUser.ID, getUserIDs(users))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "One or more users cannot be added to this group"})
+		return
+	}
+
+	restricted, err := contactsOnlyViolated(CurrentUser.ID, users)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if restricted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "One or more users only accept being added by contacts"})
+		return
+	}
+
 	// Create the group chat
+	// The photo starts empty, it can be uploaded afterwards
 	newChat := models.Chat{
-		IsGroup:   true,
-		Name:      body.Name,
-		ChatPhoto: "https://picsum.photos/seed/" + body.Name + "/200",
+		IsGroup:     true,
+		Name:        body.Name,
+		Description: body.Description,
 	}
 	if err := services.DB.Create(&newChat).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
@@ -60,6 +84,7 @@ func CreateGroupChat(c *gin.Context) {
 	chatUsers = append(chatUsers, models.ChatUser{
 		ChatID: newChat.ID,
 		UserID: CurrentUser.ID,
+		Role:   models.ChatRoleOwner,
 	})
 	for _, u := range users {
 		// Prevent duplicates if the creator username was included in the list
@@ -69,6 +94,7 @@ func CreateGroupChat(c *gin.Context) {
 		chatUsers = append(chatUsers, models.ChatUser{
 			ChatID: newChat.ID,
 			UserID: u.ID,
+			Role:   models.ChatRoleMember,
 		})
 	}
 
@@ -78,11 +104,14 @@ func CreateGroupChat(c *gin.Context) {
 		return
 	}
 
+	recordChanges(chatChange(newChat.ID))
+
 	summary := models.ChatSummary{
-		ChatID:    newChat.ID,
-		IsGroup:   true,
-		ChatName:  newChat.Name,
-		ChatPhoto: newChat.ChatPhoto,
+		ChatID:      newChat.ID,
+		IsGroup:     true,
+		ChatName:    newChat.Name,
+		ChatPhoto:   newChat.ChatPhoto,
+		Description: newChat.Description,
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"chat": summary})
@@ -133,6 +162,26 @@ func AddUsersToGroupChat(c *gin.Context) {
 		return
 	}
 
+	blocked, err := anyBlocked(CurrentUser.ID, getUserIDs(usersToAdd))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": "One or more users cannot be added to this group"})
+		return
+	}
+
+	restricted, err := contactsOnlyViolated(CurrentUser.ID, usersToAdd)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if restricted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "One or more users only accept being added by contacts"})
+		return
+	}
+
 	// Filter out users already in the chat
 	var existing []string
 	services.DB.
@@ -154,6 +203,7 @@ func AddUsersToGroupChat(c *gin.Context) {
 		newChatUsers = append(newChatUsers, models.ChatUser{
 			ChatID: chatID,
 			UserID: u.ID,
+			Role:   models.ChatRoleMember,
 		})
 	}
 	if len(newChatUsers) == 0 {
@@ -167,6 +217,14 @@ func AddUsersToGroupChat(c *gin.Context) {
 		return
 	}
 
+	changes := make([]models.Change, 0, 2*len(newChatUsers))
+	for _, cu := range newChatUsers {
+		changes = append(changes,
+			memberChange(chatID, cu.UserID, models.ChangeOpUpsert),
+			chatStateChange(chatID, cu.UserID, models.ChangeOpUpsert))
+	}
+	recordChanges(changes...)
+
 	c.JSON(http.StatusCreated, gin.H{"message": "Users added successfully"})
 }
 
@@ -199,9 +257,21 @@ func LeaveGroupChat(c *gin.Context) {
 		return
 	}
 
+	recordChanges(
+		memberChange(chatID, CurrentUser.ID, models.ChangeOpDelete),
+		chatStateChange(chatID, CurrentUser.ID, models.ChangeOpDelete))
+
+	// Hand the group over so it is never left without an owner
+	if chatUser.Role == models.ChatRoleOwner {
+		if err := transferGroupOwnership(chatID); err != nil {
+			log.Printf("failed to transfer ownership of group %s: %v", chatID, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Successfully removed user from group chat"})
 }
 
+// UpdateGroupChatInfo changes the name or description of a group. Only admins can do it.
 func UpdateGroupChatInfo(c *gin.Context) {
 	user, _ := c.Get("currentUser")
 	CurrentUser := user.(models.User)
@@ -213,37 +283,228 @@ func UpdateGroupChatInfo(c *gin.Context) {
 		return
 	}
 
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
 	var chat models.Chat
-	if err := services.DB.
-		Joins("JOIN chat_users cu ON cu.chat_id = chats.id").
-		Where("chats.id = ? AND cu.user_id = ? AND chats.is_group = true", chatID, CurrentUser.ID).
-		First(&chat).
-		Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Group chat not found or you’re not a member"})
-			return
-		}
+	if err := services.DB.First(&chat, "id = ?", chatID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Parse request body
+	// Parse request body, only the provided fields are updated
 	type requestBody struct {
-		Name string `json:"name" binding:"required"`
+		Name        *string `json:"name" binding:"omitempty,min=1,max=100"`
+		Description *string `json:"description" binding:"omitempty,max=500"`
 	}
 	var body requestBody
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
 		return
 	}
+	if body.Name == nil && body.Description == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
 
-	chat.Name = body.Name
+	if body.Name != nil {
+		chat.Name = *body.Name
+	}
+	if body.Description != nil {
+		chat.Description = *body.Description
+	}
 
 	if err := services.DB.Save(&chat).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recordChanges(chatChange(chat.ID))
+	broadcastChatUpdated(chat)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Chat updated successfully"})
 
 }
+
+// Sizes (in pixels) of the stored group photo; the first one is used as ChatPhoto
+var groupPhotoSizes = []int{512, 128}
+
+// UploadGroupChatPhoto replaces the photo of a group. Only admins can do it.
+func UploadGroupChatPhoto(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatIDParam := c.Param("chatId")
+	chatID, err := uuid.Parse(chatIDParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	var chat models.Chat
+	if err := services.DB.First(&chat, "id = ?", chatID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxImageUploadSize+1<<20)
+	file, _, err := c.Request.FormFile("photo")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo not provided or too large"})
+		return
+	}
+	defer file.Close()
+
+	images, err := services.ProcessSquareImage(file, groupPhotoSizes...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	urls, err := storeImages(c.Request.Context(), "chats/"+chatID.String(), images)
+	if err != nil {
+		log.Printf("failed to store photo of group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store photo"})
+		return
+	}
+
+	oldPhoto := chat.ChatPhoto
+	chat.ChatPhoto = urls[groupPhotoSizes[0]]
+	if err := services.DB.Model(&chat).Update("chat_photo", chat.ChatPhoto).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+
+	deleteStoredImages(c.Request.Context(), oldPhoto, groupPhotoSizes)
+	recordChanges(chatChange(chat.ID))
+	broadcastChatUpdated(chat)
+
+	c.JSON(http.StatusOK, gin.H{"chat_photo": chat.ChatPhoto})
+}
+
+// broadcastChatUpdated tells every member of the group that its metadata changed
+func broadcastChatUpdated(chat models.Chat) {
+	EventBroadcast <- Event{
+		ChatId: chat.ID,
+		Type:   "chat_updated",
+		Data: models.ChatSummary{
+			ChatID:      chat.ID,
+			ChatName:    chat.Name,
+			IsGroup:     chat.IsGroup,
+			ChatPhoto:   chat.ChatPhoto,
+			Description: chat.Description,
+		},
+	}
+}
+
+// transferGroupOwnership promotes the longest-standing admin (or member, if there
+// are no admins) to owner after the previous owner left.
+func transferGroupOwnership(chatID uuid.UUID) error {
+	var next models.ChatUser
+	err := services.DB.
+		Where("chat_id = ?", chatID).
+		Order(clause.Expr{SQL: "CASE WHEN role = ? THEN 0 ELSE 1 END, joined_at", Vars: []interface{}{models.ChatRoleAdmin}}).
+		First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Nobody left in the group
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := services.DB.Model(&next).Update("role", models.ChatRoleOwner).Error; err != nil {
+		return err
+	}
+
+	recordChanges(memberChange(chatID, next.UserID, models.ChangeOpUpsert))
+	return nil
+}
+
+// findGroupMember loads the membership of a user in a group chat, answering the
+// request with the appropriate error when it doesn't exist.
+func findGroupMember(c *gin.Context, chatID uuid.UUID, userID string) (models.ChatUser, bool) {
+	var chatUser models.ChatUser
+	if err := services.DB.
+		Joins("JOIN chats ON chats.id = chat_users.chat_id").
+		Where("chat_users.user_id = ? AND chat_users.chat_id = ? AND chats.is_group = true", userID, chatID).
+		First(&chatUser).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group chat not found or you’re not a member"})
+			return chatUser, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return chatUser, false
+	}
+	return chatUser, true
+}
+
+// findGroupAdmin is like findGroupMember but also requires the user to be an owner or admin.
+func findGroupAdmin(c *gin.Context, chatID uuid.UUID, userID string) (models.ChatUser, bool) {
+	chatUser, ok := findGroupMember(c, chatID, userID)
+	if !ok {
+		return chatUser, false
+	}
+	if !chatUser.IsAdmin() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only group admins can do this"})
+		return chatUser, false
+	}
+	return chatUser, true
+}
+
+// DeleteGroupChat deletes a group, with all its messages, for every member.
+// Only the owner can do it.
+func DeleteGroupChat(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatIDParam := c.Param("chatId")
+	chatID, err := uuid.Parse(chatIDParam)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	chatUser, ok := findGroupMember(c, chatID, CurrentUser.ID)
+	if !ok {
+		return
+	}
+	if chatUser.Role != models.ChatRoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the group owner can delete the group"})
+		return
+	}
+
+	// Remember who to notify, the memberships are deleted along with the chat
+	var memberIDs []string
+	if err := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ?", chatID).
+		Pluck("user_id", &memberIDs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Messages, memberships and invites cascade
+	if err := services.DB.Delete(&models.Chat{ID: chatID}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group chat"})
+		return
+	}
+
+	changes := make([]models.Change, 0, len(memberIDs))
+	for _, memberID := range memberIDs {
+		changes = append(changes, chatStateChange(chatID, memberID, models.ChangeOpDelete))
+	}
+	recordChanges(changes...)
+
+	EventBroadcast <- Event{
+		ChatId:  chatID,
+		Type:    "chat_deleted",
+		UserIDs: memberIDs,
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group chat deleted successfully"})
+}
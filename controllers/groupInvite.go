@@ -0,0 +1,403 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errInviteUnusable     = errors.New("invite link is invalid, expired or revoked")
+	errAlreadyMember      = errors.New("you are already a member of this group")
+	errJoinRequestPending = errors.New("you already have a pending request to join this group")
+)
+
+func CreateGroupInvite(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	// Parse request body (every field is optional, as is the body itself)
+	type requestBody struct {
+		ExpiresInHours   int  `json:"expires_in_hours" binding:"min=0"`
+		MaxUses          int  `json:"max_uses" binding:"min=0"`
+		RequiresApproval bool `json:"requires_approval"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invite code"})
+		return
+	}
+
+	invite := models.GroupInvite{
+		ChatID:           chatID,
+		Code:             code,
+		CreatedBy:        CurrentUser.ID,
+		MaxUses:          body.MaxUses,
+		RequiresApproval: body.RequiresApproval,
+	}
+	if body.ExpiresInHours > 0 {
+		expiresAt := time.Now().Add(time.Duration(body.ExpiresInHours) * time.Hour)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	if err := services.DB.Create(&invite).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invite": invite})
+}
+
+func GetGroupInvites(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	var invites []models.GroupInvite
+	if err := services.DB.
+		Where("chat_id = ? AND revoked_at IS NULL", chatID).
+		Order("created_at DESC").
+		Find(&invites).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invites"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invites": invites})
+}
+
+func RevokeGroupInvite(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	inviteID, err := uuid.Parse(c.Param("inviteId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	result := services.DB.Model(&models.GroupInvite{}).
+		Where("id = ? AND chat_id = ? AND revoked_at IS NULL", inviteID, chatID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite revoked successfully"})
+}
+
+// GetInvitePreview resolves an invite code to a preview of the group, so the
+// user can decide whether to join.
+func GetInvitePreview(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var invite models.GroupInvite
+	if err := services.DB.Preload("Chat").Where("code = ?", c.Param("code")).First(&invite).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errInviteUnusable.Error()})
+		return
+	}
+	if !invite.Usable(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": errInviteUnusable.Error()})
+		return
+	}
+
+	var memberCount int64
+	if err := services.DB.Model(&models.ChatUser{}).Where("chat_id = ?", invite.ChatID).Count(&memberCount).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var isMember int64
+	if err := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ?", invite.ChatID, CurrentUser.ID).
+		Count(&isMember).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": models.GroupPreview{
+		ChatID:           invite.ChatID,
+		ChatName:         invite.Chat.Name,
+		ChatPhoto:        invite.Chat.ChatPhoto,
+		MemberCount:      memberCount,
+		RequiresApproval: invite.RequiresApproval,
+		IsMember:         isMember > 0,
+	}})
+}
+
+// JoinGroupByInvite adds the user to the group behind the invite code, or queues
+// a join request when the invite requires approval.
+func JoinGroupByInvite(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var (
+		invite      models.GroupInvite
+		joinRequest *models.JoinRequest
+	)
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the invite so concurrent joins can't exceed MaxUses
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", c.Param("code")).
+			First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errInviteUnusable
+			}
+			return err
+		}
+		if !invite.Usable(time.Now()) {
+			return errInviteUnusable
+		}
+
+		var existing int64
+		if err := tx.Model(&models.ChatUser{}).
+			Where("chat_id = ? AND user_id = ?", invite.ChatID, CurrentUser.ID).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errAlreadyMember
+		}
+
+		if invite.RequiresApproval {
+			var pending int64
+			if err := tx.Model(&models.JoinRequest{}).
+				Where("chat_id = ? AND user_id = ? AND status = ?", invite.ChatID, CurrentUser.ID, models.JoinRequestPending).
+				Count(&pending).Error; err != nil {
+				return err
+			}
+			if pending > 0 {
+				return errJoinRequestPending
+			}
+
+			joinRequest = &models.JoinRequest{
+				ChatID:   invite.ChatID,
+				UserID:   CurrentUser.ID,
+				InviteID: invite.ID,
+				Status:   models.JoinRequestPending,
+			}
+			if err := tx.Create(joinRequest).Error; err != nil {
+				return err
+			}
+		} else {
+			if err := tx.Create(&models.ChatUser{
+				ChatID: invite.ChatID,
+				UserID: CurrentUser.ID,
+				Role:   models.ChatRoleMember,
+			}).Error; err != nil {
+				return err
+			}
+			if err := services.RecordChanges(tx,
+				memberChange(invite.ChatID, CurrentUser.ID, models.ChangeOpUpsert),
+				chatStateChange(invite.ChatID, CurrentUser.ID, models.ChangeOpUpsert)); err != nil {
+				return err
+			}
+		}
+
+		// A pending request reserves a use, so MaxUses also bounds the request queue
+		return tx.Model(&invite).UpdateColumn("uses", gorm.Expr("uses + 1")).Error
+	})
+
+	switch {
+	case errors.Is(err, errInviteUnusable):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errAlreadyMember):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errJoinRequestPending):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join group"})
+		return
+	}
+
+	if joinRequest != nil {
+		c.JSON(http.StatusAccepted, gin.H{"request": joinRequest})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Joined group successfully", "chat_id": invite.ChatID})
+}
+
+func GetJoinRequests(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	var requests []models.JoinRequest
+	if err := services.DB.Preload("User").
+		Where("chat_id = ? AND status = ?", chatID, models.JoinRequestPending).
+		Order("created_at").
+		Find(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch join requests"})
+		return
+	}
+
+	type joinRequestInfo struct {
+		models.JoinRequest
+		User models.PublicProfile `json:"user"`
+	}
+	requesters := make([]string, 0, len(requests))
+	for _, r := range requests {
+		requesters = append(requesters, r.UserID)
+	}
+	viewer, err := newProfileViewer(CurrentUser, requesters)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch join requests"})
+		return
+	}
+
+	response := make([]joinRequestInfo, 0, len(requests))
+	for _, r := range requests {
+		response = append(response, joinRequestInfo{
+			JoinRequest: r,
+			User:        viewer.profile(r.User),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"requests": response})
+}
+
+func AcceptJoinRequest(c *gin.Context) {
+	resolveJoinRequest(c, models.JoinRequestAccepted)
+}
+
+func RejectJoinRequest(c *gin.Context) {
+	resolveJoinRequest(c, models.JoinRequestRejected)
+}
+
+func resolveJoinRequest(c *gin.Context, status string) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	chatID, err := uuid.Parse(c.Param("chatId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	requestID, err := uuid.Parse(c.Param("requestId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+
+	if _, ok := findGroupAdmin(c, chatID, CurrentUser.ID); !ok {
+		return
+	}
+
+	var joinRequest models.JoinRequest
+	err = services.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND chat_id = ? AND status = ?", requestID, chatID, models.JoinRequestPending).
+			First(&joinRequest).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		joinRequest.Status = status
+		joinRequest.ResolvedAt = &now
+		joinRequest.ResolvedBy = &CurrentUser.ID
+		if err := tx.Save(&joinRequest).Error; err != nil {
+			return err
+		}
+
+		if status != models.JoinRequestAccepted {
+			// Give back the use the request reserved
+			return tx.Model(&models.GroupInvite{}).
+				Where("id = ? AND uses > 0", joinRequest.InviteID).
+				UpdateColumn("uses", gorm.Expr("uses - 1")).Error
+		}
+
+		// The user may have joined some other way in the meantime
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ChatUser{
+			ChatID: chatID,
+			UserID: joinRequest.UserID,
+			Role:   models.ChatRoleMember,
+		}).Error; err != nil {
+			return err
+		}
+
+		return services.RecordChanges(tx,
+			memberChange(chatID, joinRequest.UserID, models.ChangeOpUpsert),
+			chatStateChange(chatID, joinRequest.UserID, models.ChangeOpUpsert))
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Join request not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve join request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request": joinRequest})
+}
+
+// generateInviteCode returns a random, URL-safe invite code
+func generateInviteCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
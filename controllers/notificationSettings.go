@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+func GetNotificationSettings(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	c.JSON(http.StatusOK, gin.H{"notifications": CurrentUser.NotificationSettings})
+}
+
+// UpdateNotificationSettings changes the authenticated user's notification settings.
+// Only the provided fields are updated.
+func UpdateNotificationSettings(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		HideContent        *bool   `json:"hide_content"`
+		QuietAllowDMs      *bool   `json:"quiet_allow_dms"`
+		QuietAllowMentions *bool   `json:"quiet_allow_mentions"`
+		QuietSummary       *bool   `json:"quiet_summary"`
+		DigestFrequency    *string `json:"digest_frequency"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	settings := &CurrentUser.NotificationSettings
+	updates := map[string]interface{}{}
+	flags := []struct {
+		value  *bool
+		column string
+		field  *bool
+	}{
+		{body.HideContent, "hide_content", &settings.HideContent},
+		{body.QuietAllowDMs, "quiet_allow_dms", &settings.QuietAllowDMs},
+		{body.QuietAllowMentions, "quiet_allow_mentions", &settings.QuietAllowMentions},
+		{body.QuietSummary, "quiet_summary", &settings.QuietSummary},
+	}
+	for _, f := range flags {
+		if f.value == nil {
+			continue
+		}
+		updates[f.column] = *f.value
+		*f.field = *f.value
+	}
+
+	if body.DigestFrequency != nil {
+		if !models.ValidDigestFrequency(*body.DigestFrequency) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid digest_frequency, must be off, daily or weekly"})
+			return
+		}
+		updates["digest_frequency"] = *body.DigestFrequency
+		settings.DigestFrequency = *body.DigestFrequency
+	}
+
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	if err := services.DB.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": CurrentUser.NotificationSettings})
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+// Presence is what a connected client reports about itself, so that it isn't sent
+// push notifications for messages it already shows
+type Presence struct {
+	Background   bool       `json:"background"`     // The app is in the background, the connection may linger
+	ActiveChatID *uuid.UUID `json:"active_chat_id"` // The chat open on screen, if any
+
+	// Registration token of the device the connection comes from, as given when
+	// authenticating. Empty for apps that don't tell: all the user's devices are then
+	// considered to show what the connection shows.
+	DeviceToken string `json:"-"`
+}
+
+// ReadReceipt tells that a user has read a chat up to ReadAt
+type ReadReceipt struct {
+	ChatId uuid.UUID `json:"chat_id"`
+	UserID string    `json:"user_id"`
+	ReadAt time.Time `json:"read_at"`
+}
+
+// Presence of the connected clients, protected by mutex like clients. A client that
+// hasn't reported anything yet is in the foreground.
+var presences = make(map[string]Presence)
+
+func handlePresence(userID string, data json.RawMessage) error {
+	var p Presence
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	p.DeviceToken = presences[userID].DeviceToken
+	presences[userID] = p
+	mutex.Unlock()
+
+	// Opening a chat reads it
+	if p.ActiveChatID != nil && !p.Background {
+		markChatRead(userID, *p.ActiveChatID)
+	}
+	return nil
+}
+
+func handleReadReceipt(userID string, data json.RawMessage) error {
+	var r ReadReceipt
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	markChatRead(userID, r.ChatId)
+	return nil
+}
+
+// isForeground reports whether the device of the user with the token is connected
+// with the app in the foreground, in which case messages reach it over the WebSocket
+// and pushes are not needed. The user's other devices still get them.
+func isForeground(userID string, token string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := clients[userID]; !ok {
+		return false
+	}
+	p := presences[userID]
+	return !p.Background && (p.DeviceToken == "" || p.DeviceToken == token)
+}
+
+// markChatRead records that the user has read the chat until now, and tells the
+// other members. It cancels the pushes of the chat still waiting to be sent to the
+// user (see releasePush).
+func markChatRead(userID string, chatID uuid.UUID) {
+	resetBurst(userID, chatID)
+
+	now := time.Now()
+	result := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Where("last_read_at IS NULL OR last_read_at < ?", now).
+		UpdateColumn("last_read_at", now)
+	if result.Error != nil {
+		fmt.Println("Failed to mark chat as read:", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	recordChanges(chatStateChange(chatID, userID, models.ChangeOpUpsert))
+
+	EventBroadcast <- Event{
+		ChatId: chatID,
+		Type:   "read",
+		Data:   ReadReceipt{ChatId: chatID, UserID: userID, ReadAt: now},
+	}
+}
+
+// readSince returns which of the users have read the chat at or after the given time
+func readSince(chatID uuid.UUID, userIDs []string, since time.Time) (map[string]bool, error) {
+	var read []string
+	err := services.DB.Model(&models.ChatUser{}).
+		Where("chat_id = ? AND user_id IN ? AND last_read_at >= ?", chatID, userIDs, since).
+		Pluck("user_id", &read).Error
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool, len(read))
+	for _, id := range read {
+		set[id] = true
+	}
+	return set, nil
+}
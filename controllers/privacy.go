@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+func GetPrivacySettings(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	c.JSON(http.StatusOK, gin.H{"privacy": CurrentUser.PrivacySettings})
+}
+
+// UpdatePrivacySettings changes the authenticated user's privacy settings.
+// Only the provided fields are updated.
+func UpdatePrivacySettings(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		ContactsOnly       *bool   `json:"contacts_only"`
+		LastSeenVisibility *string `json:"last_seen_visibility"`
+		OnlineVisibility   *string `json:"online_visibility"`
+		PhotoVisibility    *string `json:"photo_visibility"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	settings := &CurrentUser.PrivacySettings
+	updates := map[string]interface{}{}
+	if body.ContactsOnly != nil {
+		updates["contacts_only"] = *body.ContactsOnly
+		settings.ContactsOnly = *body.ContactsOnly
+	}
+
+	visibilities := []struct {
+		value  *string
+		column string
+		field  *string
+	}{
+		{body.LastSeenVisibility, "last_seen_visibility", &settings.LastSeenVisibility},
+		{body.OnlineVisibility, "online_visibility", &settings.OnlineVisibility},
+		{body.PhotoVisibility, "photo_visibility", &settings.PhotoVisibility},
+	}
+	for _, v := range visibilities {
+		if v.value == nil {
+			continue
+		}
+		if !models.ValidVisibility(*v.value) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s, must be everyone, contacts or nobody", v.column)})
+			return
+		}
+		updates[v.column] = *v.value
+		*v.field = *v.value
+	}
+
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	if err := services.DB.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update privacy settings"})
+		return
+	}
+
+	// What others can see of the profile may have changed
+	recordChanges(userChange(CurrentUser.ID, models.ChangeOpUpsert))
+
+	c.JSON(http.StatusOK, gin.H{"privacy": CurrentUser.PrivacySettings})
+}
+
+// profileViewer builds the profiles a user is allowed to see. It knows the contacts
+// and blocks between the viewer and a set of users, loaded in one go.
+//
+// Last seen and online status are reciprocal: a user only sees them on people they
+// share their own with. The photo isn't, hiding it only hides it.
+// Across a block, in either direction, neither is shown; people who blocked the viewer
+// don't show their photo either.
+type profileViewer struct {
+	viewer    models.User
+	hasViewer map[string]bool // Users who have the viewer as a contact
+	viewerHas map[string]bool // Users the viewer has as a contact
+	blockedBy map[string]bool // Users who blocked the viewer
+	blocking  map[string]bool // Users the viewer blocked
+}
+
+// newProfileViewer loads what viewer needs to see the profiles of userIDs. The viewer
+// must be loaded with their privacy settings.
+func newProfileViewer(viewer models.User, userIDs []string) (*profileViewer, error) {
+	v := &profileViewer{
+		viewer:    viewer,
+		hasViewer: map[string]bool{},
+		viewerHas: map[string]bool{},
+		blockedBy: map[string]bool{},
+		blocking:  map[string]bool{},
+	}
+	if len(userIDs) == 0 {
+		return v, nil
+	}
+
+	var contacts []models.Contact
+	if err := services.DB.
+		Where("(user_id IN ? AND contact_id = ?) OR (user_id = ? AND contact_id IN ?)", userIDs, viewer.ID, viewer.ID, userIDs).
+		Find(&contacts).Error; err != nil {
+		return nil, err
+	}
+	for _, ct := range contacts {
+		if ct.ContactID == viewer.ID {
+			v.hasViewer[ct.UserID] = true
+		} else {
+			v.viewerHas[ct.ContactID] = true
+		}
+	}
+
+	var blocks []models.Block
+	if err := services.DB.
+		Where("(blocker_id IN ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id IN ?)", userIDs, viewer.ID, viewer.ID, userIDs).
+		Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		if b.BlockedID == viewer.ID {
+			v.blockedBy[b.BlockerID] = true
+		} else {
+			v.blocking[b.BlockedID] = true
+		}
+	}
+
+	return v, nil
+}
+
+// newUsersViewer is newProfileViewer for a list of loaded users
+func newUsersViewer(viewer models.User, users []models.User) (*profileViewer, error) {
+	return newProfileViewer(viewer, getUserIDs(users))
+}
+
+// shares reports whether owner's visibility setting lets the other user see it
+func (v *profileViewer) shares(visibility string, ownerHasOther bool) bool {
+	switch visibility {
+	case models.VisibilityEveryone:
+		return true
+	case models.VisibilityContacts:
+		return ownerHasOther
+	default:
+		return false
+	}
+}
+
+func (v *profileViewer) canSeePhoto(u models.User) bool {
+	if u.ID == v.viewer.ID {
+		return true
+	}
+	return !v.blockedBy[u.ID] && v.shares(u.PhotoVisibility, v.hasViewer[u.ID])
+}
+
+func (v *profileViewer) canSeeLastSeen(u models.User) bool {
+	if u.ID == v.viewer.ID {
+		return true
+	}
+	return !v.blockedBy[u.ID] && !v.blocking[u.ID] &&
+		v.shares(u.LastSeenVisibility, v.hasViewer[u.ID]) &&
+		v.shares(v.viewer.LastSeenVisibility, v.viewerHas[u.ID])
+}
+
+func (v *profileViewer) canSeeOnline(u models.User) bool {
+	if u.ID == v.viewer.ID {
+		return true
+	}
+	return !v.blockedBy[u.ID] && !v.blocking[u.ID] &&
+		v.shares(u.OnlineVisibility, v.hasViewer[u.ID]) &&
+		v.shares(v.viewer.OnlineVisibility, v.viewerHas[u.ID])
+}
+
+// profile is the public profile of u as the viewer is allowed to see it
+func (v *profileViewer) profile(u models.User) models.PublicProfile {
+	p := models.PublicProfile{
+		ID:          u.ID,
+		DisplayName: u.DisplayName,
+		Username:    u.Username,
+		Bio:         u.Bio,
+	}
+	if v.canSeePhoto(u) {
+		p.PhotoURL = u.PhotoURL
+	}
+	if v.canSeeLastSeen(u) {
+		p.LastSeen = u.LastSeen
+	}
+	return p
+}
+
+// online reports whether u is online, as far as the viewer is allowed to know
+func (v *profileViewer) online(u models.User) bool {
+	return v.canSeeOnline(u) && isOnline(u.ID)
+}
+
+// ownProfile is the user's profile as they see it themselves: complete
+func ownProfile(u models.User) models.PublicProfile {
+	return models.PublicProfile{
+		ID:          u.ID,
+		DisplayName: u.DisplayName,
+		Username:    u.Username,
+		PhotoURL:    u.PhotoURL,
+		Bio:         u.Bio,
+		LastSeen:    u.LastSeen,
+	}
+}
+
+// profileColumns are the user columns needed to build a public profile
+const profileColumns = "users.id, users.display_name, users.username, users.photo_url, users.bio, users.last_seen, " +
+	"users.last_seen_visibility, users.online_visibility, users.photo_visibility"
+
+// visiblePhotoSQL is the SQL counterpart of canSeePhoto, for queries that read the photo
+// of the user aliased u directly: their photo, or an empty string when viewerColumn
+// can't see it.
+func visiblePhotoSQL(u string, viewerColumn string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s.id = %[2]s OR (
+		(%[1]s.photo_visibility = '%[3]s' OR (%[1]s.photo_visibility = '%[4]s'
+			AND EXISTS (SELECT 1 FROM contacts WHERE contacts.user_id = %[1]s.id AND contacts.contact_id = %[2]s)))
+		AND NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.blocker_id = %[1]s.id AND blocks.blocked_id = %[2]s)
+	) THEN %[1]s.photo_url ELSE '' END`, u, viewerColumn, models.VisibilityEveryone, models.VisibilityContacts)
+}
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+const (
+	pushWorkers        = 8   // Notifications being prepared and sent at once
+	pushBatchSize      = 500 // Most tokens FCM accepts in one multicast
+	maxPushAttempts    = 5
+	pushRetryBaseDelay = time.Second
+	pushRetryMaxDelay  = time.Minute
+	pushReadWindow     = 3 * time.Second // How long a push waits for a read receipt that cancels it
+	deadLetterTTL      = 14 * 24 * time.Hour
+)
+
+// pushRetries holds deliveries waiting for another attempt, once their backoff is over
+var pushRetries = make(chan pushJob, 1000)
+
+// pushReady holds new notifications whose read window is over
+var pushReady = make(chan pushJob, 1000)
+
+// pushJob is a notification to deliver to a set of device tokens
+type pushJob struct {
+	message  messaging.MulticastMessage // Tokens are set per job
+	tokens   []string
+	attempts int // Attempts already made
+
+	// Before the read window is over: the message and who the devices belong to
+	content    *pushContent
+	recipients []pushRecipient
+}
+
+// How a failed delivery is handled
+type pushOutcome int
+
+const (
+	pushDropToken  pushOutcome = iota // The token is dead: forget the device
+	pushRetry                         // Temporary failure: try again later
+	pushDeadLetter                    // Anything else: keep it for inspection
+)
+
+// classifyPushError decides what to do with a token whose delivery failed. Within a
+// multicast response, an invalid argument means the token itself is malformed.
+func classifyPushError(err error) pushOutcome {
+	switch {
+	case messaging.IsUnregistered(err), messaging.IsInvalidArgument(err), messaging.IsSenderIDMismatch(err):
+		return pushDropToken
+	case messaging.IsQuotaExceeded(err), messaging.IsUnavailable(err), messaging.IsInternal(err):
+		return pushRetry
+	default:
+		return pushDeadLetter
+	}
+}
+
+// HandleNotifications sends a push notification for every new message to the devices
+// of the recipients. Work is spread over a fixed pool of workers, so one slow delivery
+// doesn't hold up the others (nor the senders of NotificationsBroadcast).
+//
+// Users with the app in the foreground get the message over the WebSocket and no
+// push. The others' pushes wait for pushReadWindow first, and are cancelled for the
+// users who read the chat meanwhile (e.g. on another screen, or by opening the app).
+func HandleNotifications(ctx context.Context) {
+	for i := 0; i < pushWorkers; i++ {
+		go pushWorker(ctx)
+	}
+	<-ctx.Done()
+}
+
+func pushWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-NotificationsBroadcast:
+			if job, ok := newMessagePush(msg); ok {
+				schedulePushRelease(ctx, job)
+			}
+		case job := <-pushReady:
+			for _, released := range releasePush(job) {
+				deliverPush(ctx, released)
+			}
+		case job := <-pushRetries:
+			deliverPush(ctx, job)
+		}
+	}
+}
+
+// schedulePushRelease hands the job back to the workers once its read window is over.
+// Should the queue be full (a burst of messages the workers can't keep up with), the
+// push is dropped rather than holding a goroutine until there is room.
+func schedulePushRelease(ctx context.Context, job pushJob) {
+	time.AfterFunc(pushReadWindow, func() {
+		select {
+		case pushReady <- job:
+		case <-ctx.Done():
+		default:
+			fmt.Println("Failed to release push: queue full, dropping notification for chat", job.content.ChatID)
+		}
+	})
+}
+
+// deliverPush sends the job in multicast batches and handles each failed token
+// according to its error
+func deliverPush(ctx context.Context, job pushJob) {
+	for start := 0; start < len(job.tokens); start += pushBatchSize {
+		batch := job.tokens[start:min(start+pushBatchSize, len(job.tokens))]
+		message := job.message
+		message.Tokens = batch
+
+		response, err := services.Push.SendMulticast(ctx, &message)
+		if err != nil {
+			// The whole request failed, not a particular token
+			handleFailedPush(job, batch, err)
+			continue
+		}
+		if response.FailureCount == 0 {
+			continue
+		}
+
+		var retry, dead []string
+		var retryErr, deadErr error
+		for i, r := range response.Responses {
+			if r.Success {
+				continue
+			}
+			switch classifyPushError(r.Error) {
+			case pushDropToken:
+				dropDeviceToken(batch[i])
+			case pushRetry:
+				retry = append(retry, batch[i])
+				retryErr = r.Error
+			default:
+				dead = append(dead, batch[i])
+				deadErr = r.Error
+			}
+		}
+		if len(retry) > 0 {
+			schedulePushRetry(job, retry, retryErr)
+		}
+		if len(dead) > 0 {
+			deadLetterPush(job, dead, deadErr)
+		}
+	}
+}
+
+// handleFailedPush handles an error that affects every token of the batch. Unlike
+// per-token errors, these are mostly network failures, so they are retried unless
+// the request itself is wrong.
+func handleFailedPush(job pushJob, tokens []string, err error) {
+	if messaging.IsInvalidArgument(err) || messaging.IsThirdPartyAuthError(err) || messaging.IsSenderIDMismatch(err) {
+		deadLetterPush(job, tokens, err)
+		return
+	}
+	schedulePushRetry(job, tokens, err)
+}
+
+// schedulePushRetry sends the tokens again after an exponential backoff with jitter,
+// or dead-letters them once out of attempts
+func schedulePushRetry(job pushJob, tokens []string, err error) {
+	job.attempts++
+	job.tokens = tokens
+	if job.attempts >= maxPushAttempts {
+		deadLetterPush(job, tokens, err)
+		return
+	}
+
+	delay := min(pushRetryBaseDelay<<(job.attempts-1), pushRetryMaxDelay)
+	delay += time.Duration(rand.Int63n(int64(delay / 2)))
+	time.AfterFunc(delay, func() {
+		select {
+		case pushRetries <- job:
+		default:
+			deadLetterPush(job, tokens, fmt.Errorf("retry queue full: %w", err))
+		}
+	})
+}
+
+func deadLetterPush(job pushJob, tokens []string, err error) {
+	payload, _ := json.Marshal(map[string]any{
+		"notification": job.message.Notification,
+		"data":         job.message.Data,
+	})
+
+	letters := make([]models.PushDeadLetter, 0, len(tokens))
+	for _, token := range tokens {
+		letters = append(letters, models.PushDeadLetter{
+			Token:    token,
+			Payload:  string(payload),
+			Error:    fmt.Sprint(err),
+			Attempts: job.attempts + 1,
+		})
+	}
+	if dbErr := services.DB.Create(&letters).Error; dbErr != nil {
+		fmt.Println("Failed to dead-letter notifications:", dbErr)
+	}
+}
+
+// dropDeviceToken forgets a device whose token FCM says is no longer valid (e.g. the
+// app was uninstalled)
+func dropDeviceToken(token string) {
+	if err := services.DB.Where("token = ?", token).Delete(&models.Device{}).Error; err != nil {
+		fmt.Println("Failed to delete invalid device token:", err)
+	}
+}
+
+// PrunePushDeadLetters deletes dead letters older than deadLetterTTL
+func PrunePushDeadLetters() {
+	if err := services.DB.
+		Where("created_at < ?", time.Now().Add(-deadLetterTTL)).
+		Delete(&models.PushDeadLetter{}).Error; err != nil {
+		fmt.Println("Failed to prune push dead letters:", err)
+		return
+	}
+
+	fmt.Println("Successfully pruned push dead letters")
+}
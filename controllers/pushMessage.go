@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+const (
+	pushBurstWindow = 30 * time.Minute // Pushes of a chat closer than this count as one burst
+	maxPushBursts   = 10000            // Expired bursts are swept past this many
+	pushChannelID   = "messages"       // Android notification channel of messages
+)
+
+// pushContent is what a message notification is built from
+type pushContent struct {
+	ChatID     uuid.UUID
+	MessageID  uuid.UUID
+	SentAt     time.Time
+	SenderName string
+	IsGroup    bool
+	GroupName  string
+	Text       string
+	Filter     *models.TextFilter // The text filter the message went through, if any
+}
+
+// pushRecipient is a device of a user the notification is for
+type pushRecipient struct {
+	UserID   string
+	Username string
+	Token    string
+
+	models.NotificationSettings
+}
+
+// Messages pushed to a user for a chat they haven't read since, shown collapsed as a
+// single notification with a count. Protected by burstMutex.
+type burstKey struct {
+	UserID string
+	ChatID uuid.UUID
+}
+
+type pushBurst struct {
+	Count int
+	Last  time.Time
+}
+
+var (
+	pushBursts = make(map[burstKey]pushBurst)
+	burstMutex = &sync.Mutex{}
+)
+
+// newMessagePush prepares the notification of a message for every device of every
+// recipient. Recipients who muted the chat or blocked the sender are skipped, as are
+// the devices looking at the app right now.
+func newMessagePush(msg Message) (pushJob, bool) {
+	var candidates []pushRecipient
+	err := services.DB.
+		Table("users").
+		Joins("JOIN chat_users cu ON cu.user_id = users.id").
+		Joins("JOIN devices ON devices.user_id = users.id").
+		Where("cu.chat_id = ?", msg.ChatId).
+		Where("users.id <> ?", msg.SenderId).
+		Where("users.deletion_requested_at IS NULL").
+		Where("cu.muted_forever = false AND (cu.muted_until IS NULL OR cu.muted_until <= ?)", time.Now()).
+		Where("NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.blocker_id = users.id AND blocks.blocked_id = ?)", msg.SenderId).
+		Select("users.id AS user_id, users.username, devices.token, users.hide_content, users.snoozed_until, " +
+			"users.quiet_allow_dms, users.quiet_allow_mentions, users.quiet_summary").
+		Scan(&candidates).Error
+	if err != nil {
+		fmt.Println("Failed to find chat users:", err)
+		return pushJob{}, false
+	}
+
+	var recipients []pushRecipient
+	for _, r := range candidates {
+		if !isForeground(r.UserID, r.Token) {
+			recipients = append(recipients, r)
+		}
+	}
+	if len(recipients) == 0 {
+		return pushJob{}, false
+	}
+
+	var sender models.User
+	if err := services.DB.
+		First(&sender, "id = ?", msg.SenderId).
+		Error; err != nil {
+		fmt.Println("Failed to load sender user:", err)
+	}
+
+	var chat models.Chat
+	if err := services.DB.
+		Select("id", "name", "is_group").
+		First(&chat, "id = ?", msg.ChatId).
+		Error; err != nil {
+		fmt.Println("Failed to load chat:", err)
+	}
+
+	content := &pushContent{
+		ChatID:     msg.ChatId,
+		MessageID:  msg.ID,
+		SentAt:     time.Now(),
+		SenderName: sender.DisplayName,
+		Text:       msg.Text,
+	}
+	if chat.IsGroup {
+		content.IsGroup = true
+		content.GroupName = chat.Name
+	}
+	if msg.TextFilterID > 0 {
+		var filter models.TextFilter
+		if err := services.DB.First(&filter, msg.TextFilterID).Error; err == nil {
+			content.Filter = &filter
+		}
+	}
+
+	return pushJob{content: content, recipients: recipients}, true
+}
+
+// releasePush decides, once the read window is over, who still needs the push: the
+// recipients who didn't come to the foreground nor read the chat. Those in quiet hours
+// only get it for the exceptions they chose (DMs, mentions), otherwise it is deferred.
+// Devices are grouped into one job per variant of the notification (hidden content,
+// burst count).
+func releasePush(job pushJob) []pushJob {
+	settings := make(map[string]models.NotificationSettings, len(job.recipients))
+	userIDs := make([]string, 0, len(job.recipients))
+	for _, r := range job.recipients {
+		if _, ok := settings[r.UserID]; !ok {
+			settings[r.UserID] = r.NotificationSettings
+			userIDs = append(userIDs, r.UserID)
+		}
+	}
+
+	// Better a push too many than a missed message
+	read, err := readSince(job.content.ChatID, userIDs, job.content.SentAt)
+	if err != nil {
+		fmt.Println("Failed to check read receipts:", err)
+	}
+	quiet, err := quietUsers(settings, job.content.SentAt)
+	if err != nil {
+		fmt.Println("Failed to check quiet hours:", err)
+	}
+
+	type variant struct {
+		hide  bool
+		count int
+	}
+	counts := make(map[string]int)
+	tokens := make(map[variant][]string)
+	deferred := make(map[string]bool)
+	for _, r := range job.recipients {
+		if read[r.UserID] || isForeground(r.UserID, r.Token) || deferred[r.UserID] {
+			continue
+		}
+		if quiet[r.UserID] && !quietException(r, job.content) {
+			deferred[r.UserID] = true
+			if r.QuietSummary {
+				deferPush(r.UserID, job.content.ChatID, job.content.SentAt)
+			}
+			continue
+		}
+		count, ok := counts[r.UserID]
+		if !ok {
+			count = countBurst(r.UserID, job.content.ChatID, job.content.SentAt)
+			counts[r.UserID] = count
+		}
+		v := variant{hide: r.HideContent, count: count}
+		tokens[v] = append(tokens[v], r.Token)
+	}
+
+	jobs := make([]pushJob, 0, len(tokens))
+	for v, t := range tokens {
+		jobs = append(jobs, pushJob{
+			message: buildPushMessage(job.content, v.hide, v.count),
+			tokens:  t,
+		})
+	}
+	return jobs
+}
+
+// quietException reports whether the message notifies the recipient despite quiet hours
+func quietException(r pushRecipient, content *pushContent) bool {
+	return (r.QuietAllowDMs && !content.IsGroup) || (r.QuietAllowMentions && mentions(content.Text, r.Username))
+}
+
+// buildPushMessage builds the notification of a message. Notifications of the same
+// chat replace each other on the device, the last one counting the messages of the
+// burst. With hide, the text of the message is left out.
+func buildPushMessage(content *pushContent, hide bool, count int) messaging.MulticastMessage {
+	title := content.SenderName
+	if content.IsGroup {
+		title = fmt.Sprintf("%s in %s", content.SenderName, content.GroupName)
+	}
+
+	var body string
+	switch {
+	case hide && count > 1:
+		body = fmt.Sprintf("%d new messages", count)
+	case hide:
+		body = "New message"
+	default:
+		body = content.Text
+		if content.Filter != nil {
+			body = content.Filter.Emoji + " " + body
+		}
+		if count > 1 {
+			title = fmt.Sprintf("%s (%d new messages)", title, count)
+		}
+	}
+
+	chatID := content.ChatID.String()
+	data := map[string]string{
+		"type":        "message",
+		"chat_id":     chatID,
+		"message_id":  content.MessageID.String(),
+		"sender_name": content.SenderName,
+		"group_name":  content.GroupName,
+		"count":       strconv.Itoa(count),
+	}
+	if !hide {
+		data["text"] = content.Text
+	}
+	if content.Filter != nil {
+		data["text_filter"] = content.Filter.Name
+	}
+
+	return messaging.MulticastMessage{
+		Notification: &messaging.Notification{
+			Title: title,
+			Body:  body,
+		},
+		Data: data,
+		Android: &messaging.AndroidConfig{
+			CollapseKey: chatID,
+			Priority:    "high",
+			Notification: &messaging.AndroidNotification{
+				Tag:               chatID,
+				ChannelID:         pushChannelID,
+				NotificationCount: &count,
+			},
+		},
+		APNS: &messaging.APNSConfig{
+			Headers: map[string]string{
+				"apns-collapse-id": chatID,
+				"apns-push-type":   "alert",
+				"apns-priority":    "10",
+			},
+			Payload: &messaging.APNSPayload{
+				Aps: &messaging.Aps{
+					ThreadID: chatID,
+					Sound:    "default",
+				},
+			},
+		},
+	}
+}
+
+// countBurst counts a message pushed to the user for the chat, returning how many
+// were pushed since they last read it (within pushBurstWindow of each other)
+func countBurst(userID string, chatID uuid.UUID, now time.Time) int {
+	burstMutex.Lock()
+	defer burstMutex.Unlock()
+
+	if len(pushBursts) > maxPushBursts {
+		for k, b := range pushBursts {
+			if now.Sub(b.Last) > pushBurstWindow {
+				delete(pushBursts, k)
+			}
+		}
+	}
+
+	key := burstKey{UserID: userID, ChatID: chatID}
+	b := pushBursts[key]
+	if now.Sub(b.Last) > pushBurstWindow {
+		b.Count = 0
+	}
+	b.Count++
+	b.Last = now
+	pushBursts[key] = b
+	return b.Count
+}
+
+// resetBurst starts counting anew once the user has read the chat
+func resetBurst(userID string, chatID uuid.UUID) {
+	burstMutex.Lock()
+	defer burstMutex.Unlock()
+	delete(pushBursts, burstKey{UserID: userID, ChatID: chatID})
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"google.golang.org/api/option"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// fcmError returns the error the FCM client gives for an answer with the error code,
+// as only the client can build errors that messaging.IsUnregistered and the like know.
+// (503 answers are retried by the client itself, so use another status for UNAVAILABLE.)
+func fcmError(t *testing.T, status int, code string) error {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error": {"status": %q, "message": "test", "details": [{
+			"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": %q}]}}`, code, code)
+	}))
+	defer server.Close()
+
+	app, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: "test"},
+		option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := app.Messaging(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Send(context.Background(), &messaging.Message{Token: "token"})
+	if err == nil {
+		t.Fatal("expected an error from FCM")
+	}
+	return err
+}
+
+// dryRunDB replaces services.DB with a database that doesn't run statements, and
+// returns the deletes it was asked for
+func dryRunDB(t *testing.T) func() []string {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=test"}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var deletes []string
+	db.Callback().Delete().After("gorm:delete").Register("test:record", func(tx *gorm.DB) {
+		mu.Lock()
+		defer mu.Unlock()
+		deletes = append(deletes, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	})
+
+	previous := services.DB
+	services.DB = db
+	t.Cleanup(func() { services.DB = previous })
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), deletes...)
+	}
+}
+
+func TestClassifyPushError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   pushOutcome
+	}{
+		{http.StatusNotFound, "UNREGISTERED", pushDropToken},
+		{http.StatusBadRequest, "INVALID_ARGUMENT", pushDropToken},
+		{http.StatusForbidden, "SENDER_ID_MISMATCH", pushDropToken},
+		{http.StatusTooManyRequests, "QUOTA_EXCEEDED", pushRetry},
+		{http.StatusInternalServerError, "UNAVAILABLE", pushRetry},
+		{http.StatusInternalServerError, "INTERNAL", pushRetry},
+		{http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR", pushDeadLetter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := classifyPushError(fcmError(t, tt.status, tt.code)); got != tt.want {
+				t.Errorf("classifyPushError(%s) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliverPushRetriesTemporaryFailures(t *testing.T) {
+	push := &services.MemoryPush{Failures: map[string]error{
+		"busy": fcmError(t, http.StatusInternalServerError, "UNAVAILABLE"),
+	}}
+	previous := services.Push
+	services.Push = push
+	t.Cleanup(func() { services.Push = previous })
+
+	deliverPush(context.Background(), pushJob{tokens: []string{"ok", "busy"}})
+
+	if sent := push.Sent(); len(sent) != 1 || sent[0].Token != "ok" {
+		t.Fatalf("sent %+v, want only the ok token", sent)
+	}
+
+	select {
+	case job := <-pushRetries:
+		if job.attempts != 1 || len(job.tokens) != 1 || job.tokens[0] != "busy" {
+			t.Errorf("retried job has attempts %d and tokens %v, want 1 and [busy]", job.attempts, job.tokens)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the failed token was not retried")
+	}
+
+	// Once it succeeds, nothing is left to retry
+	delete(push.Failures, "busy")
+	push.Reset()
+	deliverPush(context.Background(), pushJob{tokens: []string{"busy"}, attempts: 1})
+	if sent := push.Sent(); len(sent) != 1 || sent[0].Token != "busy" {
+		t.Errorf("sent %+v on retry, want the busy token", sent)
+	}
+}
+
+func TestDeliverPushDropsUnregisteredTokens(t *testing.T) {
+	deletes := dryRunDB(t)
+
+	push := &services.MemoryPush{Failures: map[string]error{
+		"gone": fcmError(t, http.StatusNotFound, "UNREGISTERED"),
+	}}
+	previous := services.Push
+	services.Push = push
+	t.Cleanup(func() { services.Push = previous })
+
+	deliverPush(context.Background(), pushJob{tokens: []string{"ok", "gone"}})
+
+	got := deletes()
+	if len(got) != 1 || !strings.Contains(got[0], `"devices"`) || !strings.Contains(got[0], "'gone'") {
+		t.Fatalf("deletes = %v, want the device of the gone token", got)
+	}
+
+	select {
+	case job := <-pushRetries:
+		t.Errorf("unregistered token retried: %v", job.tokens)
+	case <-time.After(2 * time.Second):
+	}
+}
@@ -0,0 +1,412 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxQuietSchedules = 10
+	maxSnoozeHours    = 7 * 24
+)
+
+// quietScheduleBody is what clients send to create or replace a quiet schedule
+type quietScheduleBody struct {
+	Days     []int  `json:"days" binding:"required"`  // Weekdays, 0 is Sunday
+	Start    string `json:"start" binding:"required"` // HH:MM
+	End      string `json:"end" binding:"required"`   // HH:MM
+	Timezone string `json:"timezone" binding:"required"`
+}
+
+func GetQuietSchedules(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	var schedules []models.QuietSchedule
+	if err := services.DB.Where("user_id = ?", CurrentUser.ID).Order("created_at").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quiet schedules"})
+		return
+	}
+
+	infos := make([]models.QuietScheduleInfo, 0, len(schedules))
+	for _, s := range schedules {
+		infos = append(infos, quietScheduleInfo(s))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": infos})
+}
+
+func CreateQuietSchedule(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	schedule, ok := bindQuietSchedule(c)
+	if !ok {
+		return
+	}
+	schedule.UserID = CurrentUser.ID
+
+	var count int64
+	if err := services.DB.Model(&models.QuietSchedule{}).Where("user_id = ?", CurrentUser.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count >= maxQuietSchedules {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("You can have at most %d quiet schedules", maxQuietSchedules)})
+		return
+	}
+
+	if err := services.DB.Create(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create quiet schedule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"schedule": quietScheduleInfo(schedule)})
+}
+
+func UpdateQuietSchedule(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	existing, ok := findQuietSchedule(c, CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	schedule, ok := bindQuietSchedule(c)
+	if !ok {
+		return
+	}
+	schedule.ID = existing.ID
+	schedule.UserID = existing.UserID
+	schedule.CreatedAt = existing.CreatedAt
+
+	if err := services.DB.Save(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quiet schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedule": quietScheduleInfo(schedule)})
+}
+
+func DeleteQuietSchedule(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	schedule, ok := findQuietSchedule(c, CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	if err := services.DB.Delete(&schedule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quiet schedule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Quiet schedule deleted successfully"})
+}
+
+// SnoozeNotifications pauses the user's notifications for the next N hours
+func SnoozeNotifications(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		Hours int `json:"hours" binding:"required"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+	if body.Hours < 1 || body.Hours > maxSnoozeHours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Notifications can be snoozed for 1 to %d hours", maxSnoozeHours)})
+		return
+	}
+
+	until := time.Now().Add(time.Duration(body.Hours) * time.Hour)
+	if err := services.DB.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Update("snoozed_until", until).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to snooze notifications"})
+		return
+	}
+	CurrentUser.SnoozedUntil = &until
+
+	c.JSON(http.StatusOK, gin.H{"notifications": CurrentUser.NotificationSettings})
+}
+
+// UnsnoozeNotifications resumes the user's notifications before the snooze is over
+func UnsnoozeNotifications(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	if err := services.DB.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Update("snoozed_until", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resume notifications"})
+		return
+	}
+	CurrentUser.SnoozedUntil = nil
+
+	c.JSON(http.StatusOK, gin.H{"notifications": CurrentUser.NotificationSettings})
+}
+
+// bindQuietSchedule reads and validates a quiet schedule from the request body,
+// answering the request when it is invalid
+func bindQuietSchedule(c *gin.Context) (models.QuietSchedule, bool) {
+	var schedule models.QuietSchedule
+
+	var body quietScheduleBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return schedule, false
+	}
+
+	if len(body.Days) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A quiet schedule needs at least one day"})
+		return schedule, false
+	}
+	for _, day := range body.Days {
+		if day < 0 || day > 6 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Days must be between 0 (Sunday) and 6 (Saturday)"})
+			return schedule, false
+		}
+		schedule.Days |= 1 << day
+	}
+
+	var err error
+	if schedule.StartMinute, err = parseClock(body.Start); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start, expected HH:MM"})
+		return schedule, false
+	}
+	if schedule.EndMinute, err = parseClock(body.End); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end, expected HH:MM"})
+		return schedule, false
+	}
+
+	if _, err := time.LoadLocation(body.Timezone); err != nil || body.Timezone == "" || body.Timezone == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone, expected an IANA name such as Europe/Paris"})
+		return schedule, false
+	}
+	schedule.Timezone = body.Timezone
+
+	return schedule, true
+}
+
+// findQuietSchedule loads the user's quiet schedule of the URL, answering the request
+// when it doesn't exist
+func findQuietSchedule(c *gin.Context, userID string) (models.QuietSchedule, bool) {
+	var schedule models.QuietSchedule
+
+	scheduleID, err := uuid.Parse(c.Param("scheduleId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule ID"})
+		return schedule, false
+	}
+
+	if err := services.DB.Where("id = ? AND user_id = ?", scheduleID, userID).First(&schedule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Quiet schedule not found"})
+			return schedule, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return schedule, false
+	}
+
+	return schedule, true
+}
+
+func quietScheduleInfo(s models.QuietSchedule) models.QuietScheduleInfo {
+	days := []int{}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if s.HasDay(day) {
+			days = append(days, int(day))
+		}
+	}
+	return models.QuietScheduleInfo{
+		ID:       s.ID,
+		Days:     days,
+		Start:    fmt.Sprintf("%02d:%02d", s.StartMinute/60, s.StartMinute%60),
+		End:      fmt.Sprintf("%02d:%02d", s.EndMinute/60, s.EndMinute%60),
+		Timezone: s.Timezone,
+	}
+}
+
+// parseClock parses an HH:MM time of day into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// quietUsers returns which of the users have their notifications paused at the given
+// time, by a snooze or a quiet schedule
+func quietUsers(settings map[string]models.NotificationSettings, now time.Time) (map[string]bool, error) {
+	quiet := make(map[string]bool)
+	userIDs := make([]string, 0, len(settings))
+	for id, s := range settings {
+		if s.IsSnoozed(now) {
+			quiet[id] = true
+		} else {
+			userIDs = append(userIDs, id)
+		}
+	}
+	if len(userIDs) == 0 {
+		return quiet, nil
+	}
+
+	var schedules []models.QuietSchedule
+	if err := services.DB.Where("user_id IN ?", userIDs).Find(&schedules).Error; err != nil {
+		return quiet, err
+	}
+	for _, s := range schedules {
+		if s.Active(now) {
+			quiet[s.UserID] = true
+		}
+	}
+	return quiet, nil
+}
+
+// mentions reports whether the text mentions @username
+func mentions(text string, username string) bool {
+	if username == "" {
+		return false
+	}
+	matched, _ := regexp.MatchString("(?i)"+mentionPattern(username), text)
+	return matched
+}
+
+// mentionPattern is the regular expression of a mention of @username, in a syntax
+// both Go and Postgres (~*) understand. Dots may be inside usernames: "@ana.b"
+// doesn't mention @ana, "@ana." does.
+func mentionPattern(username string) string {
+	return `(^|[^\w@.])@` + regexp.QuoteMeta(username) + `([^\w.]|\.([^\w]|$)|$)`
+}
+
+// deferPush counts a message of the chat that wasn't pushed to the user because of
+// quiet hours, for the summary sent when they end
+func deferPush(userID string, chatID uuid.UUID, at time.Time) {
+	err := services.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "chat_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"count":   gorm.Expr("deferred_pushes.count + 1"),
+			"last_at": at,
+		}),
+	}).Create(&models.DeferredPush{UserID: userID, ChatID: chatID, Count: 1, LastAt: at}).Error
+	if err != nil {
+		fmt.Println("Failed to defer push:", err)
+	}
+}
+
+// FlushDeferredPushes sends, to every user whose quiet hours are over, a summary of
+// the messages they weren't notified of. Chats they have read since are left out.
+func FlushDeferredPushes() {
+	var userIDs []string
+	if err := services.DB.Model(&models.DeferredPush{}).Distinct("user_id").Pluck("user_id", &userIDs).Error; err != nil {
+		fmt.Println("Failed to find deferred pushes:", err)
+		return
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	var users []models.User
+	if err := services.DB.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		fmt.Println("Failed to load users of deferred pushes:", err)
+		return
+	}
+	settings := make(map[string]models.NotificationSettings, len(users))
+	for _, u := range users {
+		settings[u.ID] = u.NotificationSettings
+	}
+
+	quiet, err := quietUsers(settings, time.Now())
+	if err != nil {
+		fmt.Println("Failed to check quiet hours:", err)
+		return
+	}
+
+	for _, u := range users {
+		if quiet[u.ID] {
+			continue
+		}
+		if err := flushDeferredPushes(u.ID); err != nil {
+			fmt.Println("Failed to send deferred push summary:", err)
+		}
+	}
+}
+
+func flushDeferredPushes(userID string) error {
+	type chatCount struct {
+		ChatID uuid.UUID
+		Count  int
+	}
+	var counts []chatCount
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("deferred_pushes dp").
+			Select("dp.chat_id, dp.count").
+			Joins("JOIN chat_users cu ON cu.chat_id = dp.chat_id AND cu.user_id = dp.user_id").
+			Where("dp.user_id = ?", userID).
+			Where("cu.last_read_at IS NULL OR cu.last_read_at < dp.last_at").
+			Scan(&counts).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.DeferredPush{}).Error
+	})
+	if err != nil || len(counts) == 0 {
+		return err
+	}
+
+	var devices []string
+	if err := services.DB.Model(&models.Device{}).Where("user_id = ?", userID).Pluck("token", &devices).Error; err != nil {
+		return err
+	}
+	var tokens []string
+	for _, token := range devices {
+		if !isForeground(userID, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, c := range counts {
+		total += c.Count
+	}
+	body := fmt.Sprintf("%d new messages in %d chats", total, len(counts))
+	if total == 1 {
+		body = "1 new message"
+	} else if len(counts) == 1 {
+		body = fmt.Sprintf("%d new messages", total)
+	}
+
+	data := map[string]string{"type": "message_summary", "count": fmt.Sprint(total)}
+	if len(counts) == 1 {
+		data["chat_id"] = counts[0].ChatID.String()
+	}
+
+	deliverPush(context.Background(), pushJob{
+		message: messaging.MulticastMessage{
+			Notification: &messaging.Notification{
+				Title: "While notifications were paused",
+				Body:  body,
+			},
+			Data: data,
+		},
+		tokens: tokens,
+	})
+	return nil
+}
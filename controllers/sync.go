@@ -0,0 +1,328 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+const (
+	defaultSyncBatchSize = 200
+	maxSyncBatchSize     = 1000
+)
+
+// Sync returns everything that changed since the given sync token, in bounded batches.
+// Without a token it only returns a token for the current position: clients call it
+// right before a full download, then keep syncing from there.
+// When the token is too old the client gets 410 Gone and must download everything again.
+func Sync(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	limit := defaultSyncBatchSize
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxSyncBatchSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+			return
+		}
+	}
+
+	horizon, err := services.SyncHorizon(services.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read sync position"})
+		return
+	}
+
+	tokenStr := c.Query("token")
+	if tokenStr == "" {
+		c.JSON(http.StatusOK, gin.H{"sync": newSyncBatch(syncToken{TxID: horizon})})
+		return
+	}
+
+	from, err := decodeSyncToken(tokenStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync token"})
+		return
+	}
+	if time.Since(from.IssuedAt) > services.ChangeRetention {
+		c.JSON(http.StatusGone, gin.H{"error": "Sync token expired, a full resync is required"})
+		return
+	}
+
+	// Changes visible to the user: those of chats they're in, those addressed to them,
+	// and profile changes of the people they share a chat with
+	var changes []models.Change
+	if err := services.DB.
+		Where("tx_id < ? AND (tx_id, id) > (?, ?)", horizon, from.TxID, from.ID).
+		Where(services.DB.
+			Where("chat_id IN (SELECT chat_id FROM chat_users WHERE user_id = ?)", CurrentUser.ID).
+			Or("user_id = ?", CurrentUser.ID).
+			Or("entity = ? AND user_id IN (SELECT cu2.user_id FROM chat_users cu1 JOIN chat_users cu2 ON cu2.chat_id = cu1.chat_id WHERE cu1.user_id = ?)",
+				models.ChangeEntityUser, CurrentUser.ID)).
+		Order("tx_id, id").
+		Limit(limit + 1).
+		Find(&changes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch changes"})
+		return
+	}
+
+	hasMore := len(changes) > limit
+	next := syncToken{TxID: horizon}
+	if hasMore {
+		changes = changes[:limit]
+		last := changes[len(changes)-1]
+		next = syncToken{TxID: last.TxID, ID: last.ID}
+	}
+
+	batch := newSyncBatch(next)
+	batch.HasMore = hasMore
+	if err := resolveChanges(&batch, CurrentUser, changes); err != nil {
+		log.Printf("failed to resolve changes for user %s: %v", CurrentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sync": batch})
+}
+
+// resolveChanges loads the current state of every entity referenced by changes.
+// Entities that no longer exist (or aren't visible anymore) are reported as deleted.
+// Profiles are built as the user is allowed to see them.
+func resolveChanges(batch *models.SyncBatch, user models.User, changes []models.Change) error {
+	// Only the last change of each entity matters
+	latest := make(map[string]models.Change, len(changes))
+	for _, ch := range changes {
+		latest[ch.Entity+":"+ch.EntityID] = ch
+	}
+
+	var (
+		messageIDs []uuid.UUID
+		chatIDs    []uuid.UUID
+		members    [][]interface{}
+		userIDs    []string
+	)
+	for _, ch := range latest {
+		switch ch.Entity {
+		case models.ChangeEntityMessage:
+			id, err := uuid.Parse(ch.EntityID)
+			if err != nil {
+				continue
+			}
+			if ch.Op == models.ChangeOpDelete {
+				batch.DeletedMessages = append(batch.DeletedMessages, id)
+			} else {
+				messageIDs = append(messageIDs, id)
+			}
+		case models.ChangeEntityChat:
+			id, err := uuid.Parse(ch.EntityID)
+			if err != nil {
+				continue
+			}
+			if ch.Op == models.ChangeOpDelete {
+				batch.DeletedChats = append(batch.DeletedChats, id)
+			} else {
+				chatIDs = append(chatIDs, id)
+			}
+		case models.ChangeEntityMember:
+			if ch.ChatID == nil {
+				continue
+			}
+			if ch.Op == models.ChangeOpDelete {
+				batch.RemovedMembers = append(batch.RemovedMembers, models.SyncMember{ChatID: *ch.ChatID, UserID: ch.EntityID})
+			} else {
+				members = append(members, []interface{}{*ch.ChatID, ch.EntityID})
+			}
+		case models.ChangeEntityUser:
+			if ch.Op == models.ChangeOpDelete {
+				batch.DeletedProfiles = append(batch.DeletedProfiles, ch.EntityID)
+			} else {
+				userIDs = append(userIDs, ch.EntityID)
+			}
+		}
+	}
+
+	if len(messageIDs) > 0 {
+		// Messages hidden by a cleared history stay hidden
+		if err := services.DB.
+			Select("messages.id, messages.chat_id, messages.sender_id, messages.text, messages.kind, messages.sent_at").
+			Joins("JOIN chat_users cu ON cu.chat_id = messages.chat_id AND cu.user_id = ?", user.ID).
+			Where("messages.id IN ? AND (cu.cleared_at IS NULL OR messages.sent_at > cu.cleared_at)", messageIDs).
+			Order("messages.sent_at").
+			Find(&batch.Messages).Error; err != nil {
+			return fmt.Errorf("failed to load messages: %w", err)
+		}
+	}
+
+	if len(chatIDs) > 0 {
+		var rows []chatSummaryRow
+		if err := chatSummaryQuery(user.ID).Where("cu.chat_id IN ?", chatIDs).Scan(&rows).Error; err != nil {
+			return fmt.Errorf("failed to load chats: %w", err)
+		}
+
+		found := make(map[uuid.UUID]bool, len(rows))
+		for _, row := range rows {
+			found[row.ChatID] = true
+			batch.Chats = append(batch.Chats, row.toSummary())
+		}
+		// The user isn't a member anymore
+		for _, id := range chatIDs {
+			if !found[id] {
+				batch.DeletedChats = append(batch.DeletedChats, id)
+			}
+		}
+	}
+
+	if len(members) > 0 {
+		var chatUsers []models.ChatUser
+		if err := services.DB.
+			Select("chat_id, user_id, role").
+			Where("(chat_id, user_id) IN ?", members).
+			Find(&chatUsers).Error; err != nil {
+			return fmt.Errorf("failed to load members: %w", err)
+		}
+
+		found := make(map[string]bool, len(chatUsers))
+		for _, cu := range chatUsers {
+			found[cu.ChatID.String()+":"+cu.UserID] = true
+			batch.Members = append(batch.Members, models.SyncMember{ChatID: cu.ChatID, UserID: cu.UserID, Role: cu.Role})
+		}
+		for _, m := range members {
+			chatID, memberID := m[0].(uuid.UUID), m[1].(string)
+			if !found[chatID.String()+":"+memberID] {
+				batch.RemovedMembers = append(batch.RemovedMembers, models.SyncMember{ChatID: chatID, UserID: memberID})
+			}
+		}
+	}
+
+	if len(userIDs) > 0 {
+		var users []models.User
+		if err := services.DB.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+			return fmt.Errorf("failed to load profiles: %w", err)
+		}
+		viewer, err := newUsersViewer(user, users)
+		if err != nil {
+			return fmt.Errorf("failed to load profiles: %w", err)
+		}
+
+		found := make(map[string]bool, len(users))
+		for _, u := range users {
+			found[u.ID] = true
+			batch.Profiles = append(batch.Profiles, viewer.profile(u))
+		}
+		for _, id := range userIDs {
+			if !found[id] {
+				batch.DeletedProfiles = append(batch.DeletedProfiles, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+func newSyncBatch(next syncToken) models.SyncBatch {
+	next.IssuedAt = time.Now()
+	return models.SyncBatch{
+		Token:           next.encode(),
+		Messages:        []models.Message{},
+		DeletedMessages: []uuid.UUID{},
+		Chats:           []models.ChatSummary{},
+		DeletedChats:    []uuid.UUID{},
+		Members:         []models.SyncMember{},
+		RemovedMembers:  []models.SyncMember{},
+		Profiles:        []models.PublicProfile{},
+		DeletedProfiles: []string{},
+	}
+}
+
+// syncToken is the position in the change log a client has synced up to
+type syncToken struct {
+	TxID     int64
+	ID       int64
+	IssuedAt time.Time
+}
+
+func (t syncToken) encode() string {
+	raw := fmt.Sprintf("v1|%d|%d|%d", t.TxID, t.ID, t.IssuedAt.Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSyncToken(s string) (syncToken, error) {
+	var t syncToken
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return t, err
+	}
+
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 4 || parts[0] != "v1" {
+		return t, errors.New("malformed sync token")
+	}
+	if t.TxID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return t, err
+	}
+	if t.ID, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return t, err
+	}
+	issuedAt, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return t, err
+	}
+	t.IssuedAt = time.Unix(issuedAt, 0)
+
+	return t, nil
+}
+
+// Helpers to build change log entries
+
+// chatChange is a change to a chat's shared info, seen by every member
+func chatChange(chatID uuid.UUID) models.Change {
+	return models.Change{ChatID: &chatID, Entity: models.ChangeEntityChat, EntityID: chatID.String(), Op: models.ChangeOpUpsert}
+}
+
+// chatStateChange is a change to how one user sees a chat (settings, hidden, cleared...),
+// or the chat going away for them
+func chatStateChange(chatID uuid.UUID, userID string, op string) models.Change {
+	return models.Change{UserID: &userID, Entity: models.ChangeEntityChat, EntityID: chatID.String(), Op: op}
+}
+
+func memberChange(chatID uuid.UUID, userID string, op string) models.Change {
+	return models.Change{ChatID: &chatID, UserID: &userID, Entity: models.ChangeEntityMember, EntityID: userID, Op: op}
+}
+
+func messageChange(chatID uuid.UUID, messageID uuid.UUID, op string) models.Change {
+	return models.Change{ChatID: &chatID, Entity: models.ChangeEntityMessage, EntityID: messageID.String(), Op: op}
+}
+
+func userChange(userID string, op string) models.Change {
+	return models.Change{UserID: &userID, Entity: models.ChangeEntityUser, EntityID: userID, Op: op}
+}
+
+// recordChanges writes changes that aren't part of a transaction. A failure only
+// delays sync until the next change of the same entity, so it is just logged.
+func recordChanges(changes ...models.Change) {
+	if err := services.RecordChanges(services.DB, changes...); err != nil {
+		log.Printf("failed to record changes: %v", err)
+	}
+}
+
+func PruneChangeLog() {
+	if err := services.PruneChanges(); err != nil {
+		fmt.Println("Failed to prune change log:", err)
+		return
+	}
+
+	fmt.Println("Successfully pruned change log")
+}
@@ -1,103 +1,384 @@
 package controllers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
 )
 
-var TextFilters = []models.TextFilter{
-	{
-		ID:      0,
-		Name:    "None",
-		Emoji:   "🙄",
-		Command: "",
-	},
-	{
-		ID:      1,
-		Name:    "Flirting",
-		Emoji:   "💘",
-		Command: "in a flirty manner",
-	},
-	{
-		ID:      2,
-		Name:    "Pirate",
-		Emoji:   "🏴‍☠️",
-		Command: "like a pirate",
-	},
-	{
-		ID:      3,
-		Name:    "Shakespeare",
-		Emoji:   "🧙‍♂️",
-		Command: "as if you were a Shakespearean character",
-	},
-	{
-		ID:      4,
-		Name:    "Glitch",
-		Emoji:   "💻",
-		Command: "with lots of typing errors",
-	},
-	{
-		ID:      5,
-		Name:    "Emoji",
-		Emoji:   "😀",
-		Command: "using only emojis",
-	},
-	{
-		ID:      6,
-		Name:    "Yoda",
-		Emoji:   "👽",
-		Command: "like Yoda",
-	},
-	{
-		ID:      7,
-		Name:    "Valley Girl",
-		Emoji:   "💅",
-		Command: "like a stereotypical valley girl, saying 'like' a lot",
-	},
-	{
-		ID:      8,
-		Name:    "Drama Queen",
-		Emoji:   "🎭",
-		Command: "in a dramatic and over-the-top way",
-	},
-	{
-		ID:      9,
-		Name:    "Detective Noir",
-		Emoji:   "🕵️‍♂️",
-		Command: "like a noir detective narrating a mystery",
-	},
-	{
-		ID:      10,
-		Name:    "Corporate Jargon",
-		Emoji:   "📊",
-		Command: "using only corporate business jargon",
-	},
-	{
-		ID:      11,
-		Name:    "Karen",
-		Emoji:   "🧍‍♀️",
-		Command: "like a person demanding to speak to the manager",
-	},
-	{
-		ID:      12,
-		Name:    "Minion",
-		Emoji:   "🍌",
-		Command: "like a minion from the Despicable Me movies",
-	},
-	{
-		ID:      13,
-		Name:    "Zen Master",
-		Emoji:   "🧘",
-		Command: "like a calm zen master sharing ancient wisdom",
-	},
-	{
-		ID: 14,
-		Name: "Shrek",
-		Emoji: "🧅",
-		Command: "like Shrek, using ogre slang and swamp metaphors",
-	},
-}
+const (
+	maxTextFilterNameLength    = 32
+	minTextFilterCommandLength = 3
+	maxTextFilterCommandLength = 200
+	maxPrivateTextFilters      = 20 // Per user
+	maxGroupTextFilters        = 20 // Per group
+	moderationTimeout          = 10 * time.Second
+)
+
+// noneFilter is listed first so clients can offer sending messages unchanged
+var noneFilter = models.TextFilter{ID: 0, Name: "None", Emoji: "🙄", Scope: models.TextFilterSystem}
 
+// GetTextFilters lists the text filters the user can use: the system ones, their
+// private ones and those of their groups (only the group of ?chat_id= when given)
 func GetTextFilters(c *gin.Context) {
-	c.JSON(200, gin.H{"textfilters": TextFilters})
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	groups := services.DB.Table("chat_users").Select("chat_id").Where("user_id = ?", CurrentUser.ID)
+	if chatIDStr := c.Query("chat_id"); chatIDStr != "" {
+		chatID, err := uuid.Parse(chatIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+			return
+		}
+		groups = groups.Where("chat_id = ?", chatID)
+	}
+
+	var filters []models.TextFilter
+	if err := services.DB.
+		Where("scope = ?", models.TextFilterSystem).
+		Or("scope = ? AND owner_id = ?", models.TextFilterPrivate, CurrentUser.ID).
+		Or("scope = ? AND chat_id IN (?)", models.TextFilterGroup, groups).
+		Order("CASE scope WHEN 'system' THEN 0 WHEN 'private' THEN 1 ELSE 2 END, id").
+		Find(&filters).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch text filters"})
+		return
+	}
+
+	c.JSON(200, gin.H{"textfilters": append([]models.TextFilter{noneFilter}, filters...)})
+}
+
+// CreateTextFilter creates a private text filter, or one shared with a group chat
+// when chat_id is given
+func CreateTextFilter(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	type requestBody struct {
+		Name    string     `json:"name" binding:"required"`
+		Emoji   string     `json:"emoji" binding:"required"`
+		Command string     `json:"command" binding:"required"`
+		ChatID  *uuid.UUID `json:"chat_id"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	filter := models.TextFilter{
+		Name:    strings.TrimSpace(body.Name),
+		Emoji:   strings.TrimSpace(body.Emoji),
+		Command: strings.TrimSpace(body.Command),
+		Scope:   models.TextFilterPrivate,
+		OwnerID: &CurrentUser.ID,
+	}
+
+	// Filters of a group are counted per group, private ones per user
+	count := services.DB.Model(&models.TextFilter{})
+	limit := maxPrivateTextFilters
+	if body.ChatID != nil {
+		if _, ok := findGroupMember(c, *body.ChatID, CurrentUser.ID); !ok {
+			return
+		}
+		filter.Scope = models.TextFilterGroup
+		filter.ChatID = body.ChatID
+		count = count.Where("scope = ? AND chat_id = ?", models.TextFilterGroup, *body.ChatID)
+		limit = maxGroupTextFilters
+	} else {
+		count = count.Where("scope = ? AND owner_id = ?", models.TextFilterPrivate, CurrentUser.ID)
+	}
+
+	var existing int64
+	if err := count.Count(&existing).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if existing >= int64(limit) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("There can be at most %d text filters here", limit)})
+		return
+	}
+
+	if !checkTextFilter(c, filter) {
+		return
+	}
+
+	if err := services.DB.Create(&filter).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create text filter"})
+		return
+	}
+
+	notifyTextFiltersChanged(filter)
+
+	c.JSON(http.StatusCreated, gin.H{"textfilter": filter})
+}
+
+// UpdateTextFilter changes the name, emoji or command of a filter the user can manage
+func UpdateTextFilter(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	filter, ok := findManagedTextFilter(c, CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	type requestBody struct {
+		Name    *string `json:"name"`
+		Emoji   *string `json:"emoji"`
+		Command *string `json:"command"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
+		return
+	}
+
+	if body.Name != nil {
+		filter.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Emoji != nil {
+		filter.Emoji = strings.TrimSpace(*body.Emoji)
+	}
+	if body.Command != nil {
+		filter.Command = strings.TrimSpace(*body.Command)
+	}
+
+	if !checkTextFilter(c, filter) {
+		return
+	}
+
+	if err := services.DB.Model(&filter).Updates(map[string]interface{}{
+		"name":    filter.Name,
+		"emoji":   filter.Emoji,
+		"command": filter.Command,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update text filter"})
+		return
+	}
+
+	notifyTextFiltersChanged(filter)
+
+	c.JSON(http.StatusOK, gin.H{"textfilter": filter})
+}
+
+func DeleteTextFilter(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	filter, ok := findManagedTextFilter(c, CurrentUser.ID)
+	if !ok {
+		return
+	}
+
+	if err := services.DB.Delete(&filter).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete text filter"})
+		return
+	}
+
+	notifyTextFiltersChanged(filter)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Text filter deleted successfully"})
+}
+
+// UnknownTextFilterError is returned for a text filter that doesn't exist, or that the
+// user can't use in the chat
+type UnknownTextFilterError struct {
+	ID int
+}
+
+func (e *UnknownTextFilterError) Error() string {
+	return fmt.Sprintf("unknown text filter %d", e.ID)
+}
+
+// findTextFilter loads a text filter the user can use in the chat
+func findTextFilter(id int, userID string, chatID uuid.UUID) (models.TextFilter, error) {
+	var filter models.TextFilter
+	if id <= 0 {
+		return filter, &UnknownTextFilterError{ID: id}
+	}
+
+	err := services.DB.
+		Where("id = ?", id).
+		Where(services.DB.
+			Where("scope = ?", models.TextFilterSystem).
+			Or("scope = ? AND owner_id = ?", models.TextFilterPrivate, userID).
+			Or("scope = ? AND chat_id = ? AND EXISTS (SELECT 1 FROM chat_users WHERE chat_users.chat_id = text_filters.chat_id AND chat_users.user_id = ?)",
+				models.TextFilterGroup, chatID, userID)).
+		First(&filter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return filter, &UnknownTextFilterError{ID: id}
+	}
+	return filter, err
+}
+
+// findManagedTextFilter loads the text filter of the URL if the user can change it:
+// the creator of a private filter, the creator or an admin of the group of a group
+// filter. The request is answered otherwise.
+func findManagedTextFilter(c *gin.Context, userID string) (models.TextFilter, bool) {
+	var filter models.TextFilter
+
+	id, err := strconv.Atoi(c.Param("filterId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid text filter ID"})
+		return filter, false
+	}
+
+	if err := services.DB.Where("id = ? AND scope <> ?", id, models.TextFilterSystem).First(&filter).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Text filter not found"})
+			return filter, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return filter, false
+	}
+
+	isOwner := filter.OwnerID != nil && *filter.OwnerID == userID
+	switch {
+	case filter.Scope == models.TextFilterPrivate && !isOwner:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Text filter not found"})
+		return filter, false
+	case filter.Scope == models.TextFilterGroup && !isOwner:
+		if _, ok := findGroupAdmin(c, *filter.ChatID, userID); !ok {
+			return filter, false
+		}
+	case filter.Scope == models.TextFilterGroup:
+		if _, ok := findGroupMember(c, *filter.ChatID, userID); !ok {
+			return filter, false
+		}
+	}
+
+	return filter, true
+}
+
+// checkTextFilter validates the filter and runs its text through moderation, answering
+// the request when it can't be saved
+func checkTextFilter(c *gin.Context, filter models.TextFilter) bool {
+	if msg := validateTextFilter(filter); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), moderationTimeout)
+	defer cancel()
+
+	result, err := services.Moderation.Moderate(ctx, filter.Name+"\n"+filter.Command)
+	if err != nil {
+		fmt.Println("Failed to moderate text filter:", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Couldn't check the text filter, try again later"})
+		return false
+	}
+	if result.Flagged {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "This text filter goes against our content policies"})
+		return false
+	}
+	return true
+}
+
+// validateTextFilter returns why the filter is invalid, or an empty string
+func validateTextFilter(filter models.TextFilter) string {
+	if n := utf8.RuneCountInString(filter.Name); n < 1 || n > maxTextFilterNameLength {
+		return fmt.Sprintf("The name must have between 1 and %d characters", maxTextFilterNameLength)
+	}
+	if !isEmoji(filter.Emoji) {
+		return "The emoji must be a single emoji"
+	}
+	if n := utf8.RuneCountInString(filter.Command); n < minTextFilterCommandLength || n > maxTextFilterCommandLength {
+		return fmt.Sprintf("The command must have between %d and %d characters", minTextFilterCommandLength, maxTextFilterCommandLength)
+	}
+	return ""
+}
+
+// isEmoji reports whether s is a single emoji, possibly made of several code points
+// (skin tones, flags, ZWJ sequences like 🏴‍☠️)
+func isEmoji(s string) bool {
+	if s == "" || utf8.RuneCountInString(s) > 10 {
+		return false
+	}
+
+	keycap := strings.ContainsRune(s, 0x20E3)
+	pictographs := 0
+	for i, r := range s {
+		switch {
+		case keycap && i == 0 && (r >= '0' && r <= '9' || r == '#' || r == '*'): // Keycaps (1️⃣)
+			pictographs++
+		case r >= 0x1F000 && r <= 0x1FAFF, // Pictographs, emoticons, flags, skin tones...
+			r >= 0x2300 && r <= 0x23FF, // Technical symbols (⌚, ⏰...)
+			r >= 0x2600 && r <= 0x27BF, // Miscellaneous symbols and dingbats
+			r >= 0x2B00 && r <= 0x2BFF, // Arrows and stars (⭐...)
+			r == 0x00A9 || r == 0x00AE || r == 0x203C || r == 0x2049 || r == 0x2122 || r == 0x2139:
+			pictographs++
+		case r == 0x200D, // Zero width joiner
+			r == 0xFE0F,                  // Emoji presentation
+			r == 0x20E3,                  // Keycap
+			r >= 0xE0020 && r <= 0xE007F: // Tags (subdivision flags)
+		default:
+			return false
+		}
+	}
+	return pictographs > 0
+}
+
+// notifyTextFiltersChanged tells the members of a group that its filters changed, so
+// their apps refresh the list
+func notifyTextFiltersChanged(filter models.TextFilter) {
+	if filter.Scope != models.TextFilterGroup || filter.ChatID == nil {
+		return
+	}
+	EventBroadcast <- Event{
+		ChatId: *filter.ChatID,
+		Type:   "text_filters_changed",
+	}
+}
+
+// filterModel is the LLM model of the text filter: the one configured in
+// LLM_FILTER_MODELS for system filters, the provider's default otherwise
+func filterModel(filter models.TextFilter) string {
+	if filter.Scope != models.TextFilterSystem {
+		return ""
+	}
+	return services.LLMFilterModels[filter.ID]
+}
+
+// filterTimeout bounds the time a filtered message can take to be sent, retries included
+const filterTimeout = 45 * time.Second
+
+// filterErrorMessage tells the sender why their filtered message couldn't be sent
+func filterErrorMessage(err error) string {
+	var unknownErr *UnknownTextFilterError
+	if errors.As(err, &unknownErr) {
+		return "This text filter doesn't exist anymore"
+	}
+	if errors.Is(err, errFilterOutputRejected) {
+		return "The text filter couldn't rewrite this message, try again"
+	}
+	if errors.Is(err, services.ErrLLMCircuitOpen) {
+		return "Text filters are unavailable right now, try again later or send the message without a filter"
+	}
+
+	var llmErr *services.LLMError
+	if !errors.As(err, &llmErr) {
+		return err.Error()
+	}
+	switch llmErr.Kind {
+	case services.LLMRateLimited:
+		return "Text filters are busy right now, try again in a moment"
+	case services.LLMTimeout:
+		return "The text filter took too long to answer, try again"
+	case services.LLMBadRequest:
+		return "The text filter couldn't rewrite this message"
+	default:
+		return "Text filters are unavailable right now, try again later or send the message without a filter"
+	}
 }
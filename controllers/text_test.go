@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shogoshima/divertidachat-backend/models"
+)
+
+func TestIsEmoji(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"😀", true},
+		{"🏴‍☠️", true}, // ZWJ sequence
+		{"👍🏽", true},   // Skin tone
+		{"🇧🇷", true},   // Flag
+		{"⭐", true},
+		{"❤️", true},  // Presentation selector
+		{"1️⃣", true}, // Keycap
+		{"", false},
+		{"a", false},
+		{"1", false},
+		{"😀a", false},
+		{"hi", false},
+		{strings.Repeat("😀", 11), false},
+	}
+	for _, tt := range tests {
+		if got := isEmoji(tt.s); got != tt.want {
+			t.Errorf("isEmoji(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTextFilter(t *testing.T) {
+	valid := models.TextFilter{Name: "Pirate", Emoji: "🏴‍☠️", Command: "like a pirate"}
+	tests := []struct {
+		name   string
+		change func(f *models.TextFilter)
+		valid  bool
+	}{
+		{"valid", func(f *models.TextFilter) {}, true},
+		{"no name", func(f *models.TextFilter) { f.Name = "" }, false},
+		{"long name", func(f *models.TextFilter) { f.Name = strings.Repeat("á", maxTextFilterNameLength+1) }, false},
+		{"not an emoji", func(f *models.TextFilter) { f.Emoji = ":)" }, false},
+		{"short command", func(f *models.TextFilter) { f.Command = "ok" }, false},
+		{"long command", func(f *models.TextFilter) { f.Command = strings.Repeat("a", maxTextFilterCommandLength+1) }, false},
+	}
+	for _, tt := range tests {
+		f := valid
+		tt.change(&f)
+		if msg := validateTextFilter(f); (msg == "") != tt.valid {
+			t.Errorf("%s: validateTextFilter() = %q, want valid %v", tt.name, msg, tt.valid)
+		}
+	}
+}
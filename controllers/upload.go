@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+// storeImages saves every size of a processed image under prefix and returns their
+// URLs by size. Names are random so clients never see a stale cached copy.
+func storeImages(ctx context.Context, prefix string, images map[int][]byte) (map[int]string, error) {
+	base := prefix + "/" + uuid.NewString()
+
+	urls := make(map[int]string, len(images))
+	for size, data := range images {
+		url, err := services.FileStorage.Put(ctx, fmt.Sprintf("%s_%d.jpg", base, size), bytes.NewReader(data), "image/jpeg")
+		if err != nil {
+			return nil, err
+		}
+		urls[size] = url
+	}
+
+	return urls, nil
+}
+
+// deleteStoredImages removes every size of an image previously saved by storeImages,
+// given the URL of its first size. URLs not owned by our storage are left alone.
+func deleteStoredImages(ctx context.Context, url string, sizes []int) {
+	key, ok := services.FileStorage.KeyFromURL(url)
+	if !ok {
+		return
+	}
+
+	base, ok := strings.CutSuffix(key, fmt.Sprintf("_%d.jpg", sizes[0]))
+	if !ok {
+		return
+	}
+
+	for _, size := range sizes {
+		if err := services.FileStorage.Delete(ctx, fmt.Sprintf("%s_%d.jpg", base, size)); err != nil {
+			log.Printf("failed to delete stored image %s: %v", base, err)
+		}
+	}
+}
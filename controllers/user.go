@@ -3,18 +3,23 @@ package controllers
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"gorm.io/gorm"
 
 	"github.com/shogoshima/divertidachat-backend/models"
 	"github.com/shogoshima/divertidachat-backend/services"
 )
 
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 140
+)
+
 // helper to extract IDs
 func getUserIDs(users []models.User) []string {
 	ids := make([]string, len(users))
@@ -25,99 +30,129 @@ func getUserIDs(users []models.User) []string {
 }
 
 func GetUserByUsername(c *gin.Context) {
-	username := c.Param("username")
-	var user models.User
-	if err := services.DB.
-		Where("username = ?", username).First(&user).Error; err != nil {
+	current, _ := c.Get("currentUser")
+	CurrentUser := current.(models.User)
+
+	// An old username still finds the user, the response tells the client it changed
+	user, renamed, err := findUserByUsername(c.Param("username"))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"profile": models.PublicProfile{
-		ID:          user.ID,
-		DisplayName: user.DisplayName,
-		Username:    user.Username,
-		PhotoURL:    user.PhotoURL,
-		LastSeen:    user.LastSeen,
-	}})
+	// Privacy settings and blocks decide what the current user can see
+	viewer, err := newProfileViewer(CurrentUser, []string{user.ID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"profile": viewer.profile(user), "online": viewer.online(user), "renamed": renamed})
 }
 
-// UpdateUser updates a user's profile.
-// The user must be authenticated; additional checks can be done to ensure users only update their own profile.
+// UpdateUser partially updates the authenticated user's profile: only the provided
+// fields change. The photo can only be removed or set to an image we store.
 func UpdateUser(c *gin.Context) {
 	user, _ := c.Get("currentUser")
 	CurrentUser := user.(models.User)
 
-	var input models.PublicProfile
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	type requestBody struct {
+		DisplayName *string `json:"display_name"`
+		Username    *string `json:"username"`
+		Bio         *string `json:"bio"`
+		PhotoURL    *string `json:"photo_url"`
+	}
+	var body requestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload: " + err.Error()})
 		return
 	}
 
-	// Update allowed fields
-	CurrentUser.Username = input.Username
+	updates := map[string]interface{}{}
+	oldPhoto := CurrentUser.PhotoURL
 
-	var userExists models.User
-	err := services.DB.Where("username = ?", CurrentUser.Username).First(&userExists).Error
-	if err == nil {
-		// Found an existing user — this is a conflict
-		c.JSON(http.StatusConflict, gin.H{"error": "User with this username already exists"})
-		return
-	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		// Any other DB error
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
+	if body.DisplayName != nil {
+		name := strings.TrimSpace(*body.DisplayName)
+		if n := utf8.RuneCountInString(name); n < 1 || n > maxDisplayNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The display name must have between 1 and 64 characters"})
+			return
+		}
+		CurrentUser.DisplayName = name
+		CurrentUser.CustomDisplayName = true
+		updates["display_name"] = name
+		updates["custom_display_name"] = true
 	}
 
-	if err := services.DB.Save(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if body.Bio != nil {
+		bio := strings.TrimSpace(*body.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The bio can have at most 140 characters"})
+			return
+		}
+		CurrentUser.Bio = bio
+		updates["bio"] = bio
 	}
 
-	c.JSON(http.StatusOK, gin.H{"profile": models.PublicProfile{
-		ID:          CurrentUser.ID,
-		DisplayName: CurrentUser.DisplayName,
-		Username:    CurrentUser.Username,
-		PhotoURL:    CurrentUser.PhotoURL,
-		LastSeen:    CurrentUser.LastSeen,
-	}})
-}
+	if body.PhotoURL != nil {
+		// Only photos the user uploaded themselves (see UploadProfilePhoto)
+		if *body.PhotoURL != "" {
+			key, ok := services.FileStorage.KeyFromURL(*body.PhotoURL)
+			if !ok || !strings.HasPrefix(key, "users/"+CurrentUser.ID+"/") {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "The photo must be uploaded first"})
+				return
+			}
+		}
+		CurrentUser.PhotoURL = *body.PhotoURL
+		CurrentUser.CustomPhoto = true
+		updates["photo_url"] = CurrentUser.PhotoURL
+		updates["custom_photo"] = true
+	}
 
-func DeleteUser(c *gin.Context) {
-	user, _ := c.Get("currentUser")
-	CurrentUser := user.(models.User)
+	// Renaming to the current username is a no-op
+	var username string
+	if body.Username != nil {
+		username = normalizeUsername(*body.Username)
+		if username == CurrentUser.Username {
+			username = ""
+		} else if msg := validateUsername(username); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+	}
 
-	// Gather all one‑on‑one chat IDs the user is in
-	var dmChatIDs []uuid.UUID
-	if err := services.DB.
-		Model(&models.ChatUser{}).
-		Joins("JOIN chats ON chats.id = chat_users.chat_id").
-		Where("chat_users.user_id = ? AND chats.is_group = false", CurrentUser.ID).
-		Pluck("chat_users.chat_id", &dmChatIDs).
-		Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query user chats"})
+	if len(updates) == 0 && username == "" {
+		c.JSON(http.StatusOK, gin.H{"profile": ownProfile(CurrentUser)})
 		return
 	}
 
-	// Delete the user (this cascades to ChatUser via OnDelete:CASCADE on UserID)
-	if err := services.DB.Delete(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+	err := services.DB.Transaction(func(tx *gorm.DB) error {
+		if username != "" {
+			if err := renameUser(tx, &CurrentUser, username); err != nil {
+				return err
+			}
+			updates["username"] = username
+		}
+
+		if err := tx.Model(&models.User{}).Where("id = ?", CurrentUser.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return services.RecordChanges(tx, userChange(CurrentUser.ID, models.ChangeOpUpsert))
+	})
+	if errors.Is(err, errUsernameTaken) || isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "User with this username already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
 		return
 	}
 
-	// Delete any DMs that the user was part of
-	// (only non‑group chats, per your requirement)
-	if len(dmChatIDs) > 0 {
-		if err := services.DB.
-			Where("id IN ?", dmChatIDs).
-			Delete(&models.Chat{}).
-			Error; err != nil {
-			// Non‑fatal: user is gone, but log the error
-			log.Printf("failed to delete DMs for deleted user %s: %v", CurrentUser.ID, err)
-		}
+	if CurrentUser.PhotoURL != oldPhoto {
+		deleteStoredImages(c.Request.Context(), oldPhoto, profilePhotoSizes)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User and their one-to-one chats deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{"profile": ownProfile(CurrentUser)})
 }
 
 func GetAuthenticatedUser(c *gin.Context) {
@@ -126,18 +161,12 @@ func GetAuthenticatedUser(c *gin.Context) {
 
 	now := time.Now()
 	CurrentUser.LastSeen = &now
-	if err := services.DB.Save(&user).Error; err != nil {
+	if err := services.DB.Model(&CurrentUser).UpdateColumn("last_seen", now).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"profile": models.PublicProfile{
-		ID:          CurrentUser.ID,
-		DisplayName: CurrentUser.DisplayName,
-		Username:    CurrentUser.Username,
-		PhotoURL:    CurrentUser.PhotoURL,
-		LastSeen:    CurrentUser.LastSeen,
-	}})
+	c.JSON(http.StatusOK, gin.H{"profile": ownProfile(CurrentUser)})
 }
 
 func ResetGPTUsage() {
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+// Sizes profile photos are stored in; the first one is the URL saved in the profile
+var profilePhotoSizes = []int{512, 128}
+
+// UploadProfilePhoto replaces the authenticated user's photo with an uploaded image.
+// From then on logging in no longer copies the photo from the auth provider.
+func UploadProfilePhoto(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxImageUploadSize+1<<20)
+	file, _, err := c.Request.FormFile("photo")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo not provided or too large"})
+		return
+	}
+	defer file.Close()
+
+	images, err := services.ProcessSquareImage(file, profilePhotoSizes...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	urls, err := storeImages(c.Request.Context(), "users/"+CurrentUser.ID, images)
+	if err != nil {
+		log.Printf("failed to store photo of user %s: %v", CurrentUser.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store photo"})
+		return
+	}
+
+	setProfilePhoto(c, CurrentUser, urls[profilePhotoSizes[0]])
+}
+
+// DeleteProfilePhoto removes the authenticated user's photo
+func DeleteProfilePhoto(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	setProfilePhoto(c, CurrentUser, "")
+}
+
+// setProfilePhoto saves the user's new photo URL and deletes the previous photo when
+// it was an upload of ours
+func setProfilePhoto(c *gin.Context, user models.User, url string) {
+	if err := services.DB.Model(&models.User{}).Where("id = ?", user.ID).
+		Updates(map[string]interface{}{"photo_url": url, "custom_photo": true}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	if user.PhotoURL != url {
+		deleteStoredImages(c.Request.Context(), user.PhotoURL, profilePhotoSizes)
+	}
+	recordChanges(userChange(user.ID, models.ChangeOpUpsert))
+
+	c.JSON(http.StatusOK, gin.H{"photo_url": url})
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+)
+
+const (
+	minSearchQueryLength   = 2
+	maxSearchQueryLength   = 64
+	defaultSearchPageSize  = 20
+	maxSearchPageSize      = 50
+	maxSearchResults       = 200 // Deeper pages aren't served, to make scraping the directory harder
+	recentChatPartnerDepth = 30 * 24 * time.Hour
+)
+
+// likeEscaper escapes the LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers finds users whose username starts with the query or whose display name
+// looks like it. Contacts come first, then people the user recently talked to in a DM.
+// Users blocked in either direction never show up.
+func SearchUsers(c *gin.Context) {
+	user, _ := c.Get("currentUser")
+	CurrentUser := user.(models.User)
+
+	query := strings.ToLower(strings.TrimSpace(c.Query("q")))
+	query = strings.TrimPrefix(query, "@")
+	if n := utf8.RuneCountInString(query); n < minSearchQueryLength || n > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The search query must have between 2 and 64 characters"})
+		return
+	}
+
+	limit := defaultSearchPageSize
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxSearchPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+			return
+		}
+	}
+
+	offset := 0
+	if offsetStr := c.Query("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset parameter"})
+			return
+		}
+	}
+	if offset >= maxSearchResults {
+		c.JSON(http.StatusOK, gin.H{"users": []models.UserSearchResult{}, "next_offset": nil})
+		return
+	}
+	if offset+limit > maxSearchResults {
+		limit = maxSearchResults - offset
+	}
+
+	type searchRow struct {
+		models.User
+		IsContact bool
+	}
+
+	// Display names are matched by trigram word similarity, which the GIN index on
+	// lower(display_name) serves; usernames by prefix, served by the pattern index.
+	var rows []searchRow
+	if err := services.DB.Raw(`
+		SELECT `+profileColumns+`,
+			contacts.contact_id IS NOT NULL AS is_contact
+		FROM users
+		LEFT JOIN contacts ON contacts.user_id = @me AND contacts.contact_id = users.id
+		WHERE users.id <> @me AND users.deletion_requested_at IS NULL AND users.anonymized_at IS NULL
+			AND (lower(users.username) LIKE @prefix OR @query <% lower(users.display_name))
+			AND NOT EXISTS (
+				SELECT 1 FROM blocks
+				WHERE (blocks.blocker_id = @me AND blocks.blocked_id = users.id)
+					OR (blocks.blocker_id = users.id AND blocks.blocked_id = @me)
+			)
+		ORDER BY
+			is_contact DESC,
+			EXISTS (
+				SELECT 1 FROM chat_users mine
+				JOIN chat_users theirs ON theirs.chat_id = mine.chat_id AND theirs.user_id = users.id
+				JOIN chats ON chats.id = mine.chat_id AND chats.is_group = false
+				WHERE mine.user_id = @me AND EXISTS (
+					SELECT 1 FROM messages WHERE messages.chat_id = mine.chat_id AND messages.sent_at > @since
+				)
+			) DESC,
+			lower(users.username) = @query DESC,
+			lower(users.username) LIKE @prefix DESC,
+			word_similarity(@query, lower(users.display_name)) DESC,
+			users.username
+		LIMIT @limit OFFSET @offset
+	`, map[string]interface{}{
+		"me":     CurrentUser.ID,
+		"query":  query,
+		"prefix": likeEscaper.Replace(query) + "%",
+		"since":  time.Now().Add(-recentChatPartnerDepth),
+		"limit":  limit + 1,
+		"offset": offset,
+	}).Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+		return
+	}
+
+	var nextOffset *int
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next := offset + limit
+		if next < maxSearchResults {
+			nextOffset = &next
+		}
+	}
+
+	users := make([]models.User, 0, len(rows))
+	for _, row := range rows {
+		users = append(users, row.User)
+	}
+	viewer, err := newUsersViewer(CurrentUser, users)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+		return
+	}
+
+	results := make([]models.UserSearchResult, 0, len(rows))
+	for _, row := range rows {
+		profile := viewer.profile(row.User)
+		profile.LastSeen = nil
+		results = append(results, models.UserSearchResult{
+			PublicProfile: profile,
+			IsContact:     row.IsContact,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": results, "next_offset": nextOffset})
+}
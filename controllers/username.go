@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shogoshima/divertidachat-backend/models"
+	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+)
+
+// A username starts with a letter and has 3 to 32 lowercase letters, digits,
+// underscores or dots. It can't end with a dot or have two dots in a row.
+var usernamePattern = regexp.MustCompile(`^[a-z][a-z0-9_.]{2,31}$`)
+
+// Usernames that can't be taken: they clash with routes (/users/me, /users/search...)
+// or could be used to impersonate the service
+var reservedUsernames = map[string]bool{
+	"me": true, "search": true, "blocks": true, "fcm": true, "privacy": true,
+	"admin": true, "administrator": true, "root": true, "system": true, "support": true,
+	"help": true, "settings": true, "api": true, "null": true, "undefined": true,
+	"divertida": true, "divertidachat": true, "moderator": true, "official": true,
+}
+
+// How long an old username stays with its previous owner (and redirects to them)
+// before someone else can claim it
+const usernameHoldPeriod = 30 * 24 * time.Hour
+
+var errUsernameTaken = errors.New("username taken")
+
+// normalizeUsername lowercases the username and drops a leading @
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+}
+
+// validateUsername returns why the (normalized) username can't be used, or "" if it can
+func validateUsername(username string) string {
+	if !usernamePattern.MatchString(username) || strings.HasSuffix(username, ".") || strings.Contains(username, "..") {
+		return "Usernames must have 3 to 32 characters: lowercase letters, digits, underscores or dots, starting with a letter"
+	}
+	if reservedUsernames[username] {
+		return "This username is reserved"
+	}
+	return ""
+}
+
+// findUserByUsername finds the user with the username, following renames: if nobody
+// has it now, the last user who had it is returned, with renamed set.
+// Disabled and deleted accounts aren't found.
+func findUserByUsername(username string) (user models.User, renamed bool, err error) {
+	err = services.DB.Where("username = ? AND deletion_requested_at IS NULL AND anonymized_at IS NULL", username).First(&user).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, false, err
+	}
+
+	var history models.UsernameHistory
+	if err := services.DB.Preload("User").Where("username = ?", normalizeUsername(username)).First(&history).Error; err != nil {
+		return user, false, err
+	}
+	if history.User.DeletionRequestedAt != nil || history.User.AnonymizedAt != nil {
+		return user, false, gorm.ErrRecordNotFound
+	}
+	return history.User, true, nil
+}
+
+// findUser loads the user with the username into user, following renames
+func findUser(username string, user *models.User) (err error) {
+	*user, _, err = findUserByUsername(username)
+	return err
+}
+
+// usernameAvailable reports whether the user can take the username: nobody else has
+// it, nor had it within the hold period
+func usernameAvailable(tx *gorm.DB, username string, userID string) (bool, error) {
+	var held models.UsernameHistory
+	err := tx.Where("username = ?", username).First(&held).Error
+	if err == nil && held.UserID != userID && time.Since(held.ChangedAt) < usernameHoldPeriod {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	var taken int64
+	if err := tx.Model(&models.User{}).Where("username = ? AND id <> ?", username, userID).Count(&taken).Error; err != nil {
+		return false, err
+	}
+	return taken == 0, nil
+}
+
+// signupUsername picks the username of a new user from their email: its local part
+// made valid, with a random number appended while it isn't available
+func signupUsername(tx *gorm.DB, email string, userID string) (string, error) {
+	base := invalidUsernameChars.ReplaceAllString(normalizeUsername(strings.Split(email, "@")[0]), "")
+	for strings.Contains(base, "..") {
+		base = strings.ReplaceAll(base, "..", ".")
+	}
+	base = strings.Trim(base, "._")
+	if len(base) > 26 { // Room for the number
+		base = strings.TrimRight(base[:26], ".")
+	}
+	if validateUsername(base) != "" {
+		base = "user"
+	}
+
+	username := base
+	for attempt := 0; attempt < 10; attempt++ {
+		if attempt > 0 {
+			username = fmt.Sprintf("%s%d", base, 1000+rand.Intn(9000))
+		}
+		ok, err := usernameAvailable(tx, username, userID)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return username, nil
+		}
+	}
+	return "", errUsernameTaken
+}
+
+// invalidUsernameChars matches what can't be part of a username
+var invalidUsernameChars = regexp.MustCompile(`[^a-z0-9_.]`)
+
+// renameUser gives the user a new username inside tx, keeping the old one in the
+// history. Names other users had recently are still held for them.
+func renameUser(tx *gorm.DB, user *models.User, username string) error {
+	ok, err := usernameAvailable(tx, username, user.ID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errUsernameTaken
+	}
+
+	// The new name stops redirecting to whoever had it before
+	if err := tx.Where("username = ?", username).Delete(&models.UsernameHistory{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Save(&models.UsernameHistory{Username: normalizeUsername(user.Username), UserID: user.ID, ChangedAt: time.Now()}).Error; err != nil {
+		return err
+	}
+
+	user.Username = username
+	return nil
+}
+
+// isUniqueViolation reports whether err comes from a unique constraint, e.g. two users
+// taking the same username at once
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
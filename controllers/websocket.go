@@ -4,17 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"sync"
 	"time"
 
-	"firebase.google.com/go/v4/messaging"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/shogoshima/divertidachat-backend/models"
 	"github.com/shogoshima/divertidachat-backend/services"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var upgrader = websocket.Upgrader{
@@ -28,6 +28,7 @@ var ActionBroadcast = make(chan Action)         // Action broadcast channel
 var mutex = &sync.Mutex{}                       // Protect clients map
 var PersistenceBroadcast = make(chan Message)   // Persistence channel
 var NotificationsBroadcast = make(chan Message) // FCM Notifications channel
+var EventBroadcast = make(chan Event)           // Chat change events channel
 
 type Message struct {
 	ID           uuid.UUID `json:"id"`
@@ -43,12 +44,21 @@ type Action struct {
 	Type   string    `json:"type"`
 }
 
+// Event tells clients that something other than a message changed (e.g. chat info)
+type Event struct {
+	ChatId  uuid.UUID `json:"chat_id"`
+	Type    string    `json:"type"`
+	Data    any       `json:"data,omitempty"`
+	UserIDs []string  `json:"-"` // Recipients, every member of the chat when empty
+}
+
 type Authorization struct {
-	IdToken string `json:"id_token"`
+	IdToken  string `json:"id_token"`
+	FCMToken string `json:"fcm_token"` // Of the device connecting, if it has one
 }
 
 type Inbound struct {
-	Type string          `json:"type"` // e.g. "message", "action"
+	Type string          `json:"type"` // e.g. "message", "action", "presence", "read"
 	Data json.RawMessage `json:"data"` // raw JSON payload
 }
 
@@ -71,9 +81,13 @@ func HandleWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	addClient(userID, conn)
+	// Nothing is sent nor received for the user until they prove who they are
+	deviceToken, ok := authenticate(userID, conn, c.Request.Context())
+	if !ok {
+		return
+	}
 
-	authenticate(userID, conn, c.Request.Context())
+	addClient(userID, conn, deviceToken)
 
 	for {
 		var in Inbound
@@ -92,6 +106,19 @@ func HandleWebSocket(c *gin.Context) {
 				continue
 			}
 
+			// The sender is whoever is connected, whatever the payload says
+			m.SenderId = userID
+
+			blocked, err := isDMBlocked(m.ChatId, m.SenderId)
+			if err != nil {
+				sendError(conn, "failed to send message")
+				continue
+			}
+			if blocked {
+				sendError(conn, "you cannot send messages to this user")
+				continue
+			}
+
 			// If no filtering, broadcast immediately:
 			if m.TextFilterID == 0 {
 				Broadcast <- m
@@ -102,26 +129,18 @@ func HandleWebSocket(c *gin.Context) {
 
 			// Otherwise, do the GPT call asynchronously:
 			go func(origConn *websocket.Conn, msg Message) {
-				// call GPT
-				var gptMessage []models.GPTMessage
-				gptMessage = append(gptMessage, models.GPTMessage{
-					Role:    "developer",
-					Content: "You are an assistant that rewrites the user’s message in the same language as it was written, without adding quotation marks.",
-				})
-				gptMessage = append(gptMessage, models.GPTMessage{
-					Role:    "user",
-					Content: "Rewrite the following message " + TextFilters[m.TextFilterID].Command + ": '" + m.Text + "'",
-				})
-
-				resp, err := services.GetGPTResponse(gptMessage, msg.SenderId)
+				ctx, cancel := context.WithTimeout(context.Background(), filterTimeout)
+				defer cancel()
+
+				text, err := applyTextFilter(ctx, msg, userID)
 				if err != nil {
-					// note: use a helper that locks and deletes if needed
-					sendError(origConn, err.Error())
+					fmt.Println("Failed to apply text filter:", err)
+					sendError(origConn, filterErrorMessage(err))
 					return
 				}
 
 				// update the text and push into your pipelines
-				msg.Text = resp
+				msg.Text = text
 
 				Broadcast <- msg
 				PersistenceBroadcast <- msg
@@ -137,6 +156,16 @@ func HandleWebSocket(c *gin.Context) {
 
 			ActionBroadcast <- a
 
+		case "presence":
+			if err := handlePresence(userID, in.Data); err != nil {
+				sendError(conn, "invalid presence payload")
+			}
+
+		case "read":
+			if err := handleReadReceipt(userID, in.Data); err != nil {
+				sendError(conn, "invalid read payload")
+			}
+
 		default:
 			sendError(conn, "unknown type "+in.Type)
 		}
@@ -222,59 +251,41 @@ func HandleMessages() {
 	}
 }
 
-func HandleNotifications(ctx context.Context) {
+func HandleEvents() {
 	for {
-		msg := <-NotificationsBroadcast
-
-		chatID := msg.ChatId
-		userID := msg.SenderId
-		fmt.Println("Broadcasting notification to chat ID:", chatID)
-
-		var tokens []string
-		err := services.DB.
-			Table("users").
-			Joins("JOIN chat_users cu ON cu.user_id = users.id").
-			Where("cu.chat_id = ?", chatID).
-			Where("users.id <> ?", userID).
-			Where("users.fcm_token IS NOT NULL").
-			Pluck("users.fcm_token", &tokens).Error
-		if err != nil {
-			fmt.Println("Failed to find chat users:", err)
-			continue
-		}
-
-		var sender models.User
-		if err := services.DB.
-			First(&sender, "id = ?", userID).
-			Error; err != nil {
-			fmt.Println("Failed to load sender user:", err)
+		event := <-EventBroadcast
+
+		recipients := event.UserIDs
+		if len(recipients) == 0 {
+			// Find all users in the chat (outside of mutex lock)
+			err := services.DB.Model(&models.ChatUser{}).
+				Where("chat_id = ?", event.ChatId).
+				Pluck("user_id", &recipients).Error
+			if err != nil {
+				fmt.Println("Failed to find chat users:", err)
+				continue
+			}
 		}
 
-		for _, token := range tokens {
-			// Construct the message.
-			message := &messaging.Message{
-				Notification: &messaging.Notification{
-					Title: fmt.Sprintf("New Message from %s", sender.DisplayName),
-					Body:  msg.Text,
-				},
-				Data: map[string]string{
-					"type":        "message",
-					"chat_id":     chatID.String(),
-					"message_id":  msg.ID.String(),
-					"sender_name": sender.DisplayName,
-					"text":        msg.Text,
-				},
-				Token: token,
+		// Lock the clients map before iterating
+		mutex.Lock()
+		for _, userID := range recipients {
+			conn, ok := clients[userID]
+			if !ok {
+				continue
 			}
 
-			// Send the message.
-			response, err := services.MessagingClient.Send(ctx, message)
+			err := conn.WriteJSON(WSResponse{
+				Type:    "event",
+				Payload: event,
+			})
 			if err != nil {
-				log.Fatalf("error sending message: %v\n", err)
-				continue
+				fmt.Println("Error writing event:", err)
+				conn.Close()
+				delete(clients, userID)
 			}
-			log.Println("Successfully sent message:", response)
 		}
+		mutex.Unlock()
 	}
 }
 
@@ -291,12 +302,18 @@ func HandlePersistence() {
 			Text:     msg.Text,
 			SenderID: msg.SenderId,
 			ChatID:   msg.ChatId,
+			Kind:     models.MessageKindText,
 			SentAt:   time.Now(),
 		}
+		if msg.TextFilterID != 0 {
+			message.Kind = models.MessageKindFiltered
+		}
 
 		err := services.DB.Create(&message).Error
 		if err != nil {
 			fmt.Println("Failed to save message to database:", err)
+		} else {
+			recordChanges(messageChange(message.ChatID, message.ID, models.ChangeOpUpsert))
 		}
 
 		err = services.DB.Model(&models.Chat{}).
@@ -305,6 +322,23 @@ func HandlePersistence() {
 		if err != nil {
 			fmt.Println("Failed to update chat", err)
 		}
+
+		// New activity brings back DMs a member deleted, and archived chats unless
+		// the user asked to keep them archived
+		var restored []models.ChatUser
+		err = services.DB.Model(&restored).
+			Clauses(clause.Returning{Columns: []clause.Column{{Name: "chat_id"}, {Name: "user_id"}}}).
+			Where("chat_id = ? AND (hidden = true OR (archived = true AND keep_archived = false))", msg.ChatId).
+			Updates(map[string]interface{}{
+				"hidden":   false,
+				"archived": gorm.Expr("archived AND keep_archived"),
+			}).Error
+		if err != nil {
+			fmt.Println("Failed to restore chat", err)
+		}
+		for _, cu := range restored {
+			recordChanges(chatStateChange(cu.ChatID, cu.UserID, models.ChangeOpUpsert))
+		}
 		fmt.Println("Chat updated successfully")
 	}
 }
@@ -316,47 +350,87 @@ func sendError(conn *websocket.Conn, msg string) {
 	})
 }
 
-func addClient(id string, conn *websocket.Conn) {
+func addClient(id string, conn *websocket.Conn, deviceToken string) {
 	mutex.Lock()
 	clients[id] = conn
+	presences[id] = Presence{DeviceToken: deviceToken}
 	fmt.Println("Client connected:", conn.RemoteAddr())
 	mutex.Unlock()
 }
 
+// disconnectClient closes the user's WebSocket connection, if they have one open
+func disconnectClient(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conn, ok := clients[id]; ok {
+		conn.Close()
+		delete(clients, id)
+	}
+	delete(presences, id)
+}
+
+// isOnline reports whether the user has a WebSocket connection open
+func isOnline(id string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := clients[id]
+	return ok
+}
+
 func removeClient(id string) {
 	mutex.Lock()
 	delete(clients, id)
+	delete(presences, id)
 	fmt.Println("Client disconnected.")
 	mutex.Unlock()
 }
 
-func authenticate(id string, conn *websocket.Conn, ctx context.Context) {
+// authenticate reads the first frame of the connection, which must carry a valid ID
+// token of the user of the URL whose account is active, and returns the registration
+// token of the device connecting, if given. The caller closes the connection when it
+// fails.
+func authenticate(id string, conn *websocket.Conn, ctx context.Context) (string, bool) {
 	var initialLoad Inbound
 	err := conn.ReadJSON(&initialLoad)
 	if err != nil {
 		fmt.Println("Read error:", err)
-		removeClient(id)
-		return
+		return "", false
 	}
 
 	if initialLoad.Type != "authentication" {
 		sendError(conn, "invalid message payload")
-		removeClient(id)
-		return
+		return "", false
 	}
 
 	var auth Authorization
 	if err := json.Unmarshal(initialLoad.Data, &auth); err != nil {
 		sendError(conn, "invalid message payload")
-		removeClient(id)
-		return
+		return "", false
 	}
 
-	_, err = services.AuthClient.VerifyIDToken(ctx, auth.IdToken)
+	token, err := services.AuthClient.VerifyIDToken(ctx, auth.IdToken)
 	if err != nil {
 		sendError(conn, "invalid message payload")
-		removeClient(id)
-		return
+		return "", false
+	}
+	if token.UID != id {
+		sendError(conn, "invalid message payload")
+		return "", false
+	}
+
+	// Disabled (pending deletion) and deleted accounts can't connect
+	var active int64
+	if err := services.DB.Model(&models.User{}).
+		Where("id = ? AND deletion_requested_at IS NULL AND anonymized_at IS NULL", token.UID).
+		Count(&active).Error; err != nil {
+		fmt.Println("Failed to check account status:", err)
+		sendError(conn, "server error, try again later")
+		return "", false
+	}
+	if active == 0 {
+		sendError(conn, "account disabled")
+		return "", false
 	}
 
+	return auth.FCMToken, true
 }
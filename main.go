@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"time"
+	_ "time/tzdata" // Quiet schedules need time zones, which the production image lacks
 
 	"github.com/robfig/cron/v3"
 	"github.com/shogoshima/divertidachat-backend/controllers"
@@ -15,6 +17,11 @@ import (
 func init() {
 	services.LoadEnvs()
 	services.InitFirebase()
+	services.InitPush()
+	services.InitMailer()
+	services.InitLLM()
+	services.InitModeration()
+	services.InitStorage()
 }
 
 func main() {
@@ -25,9 +32,19 @@ func main() {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
 
-	// Initialize cron job to reset all user usage
-	c := cron.New()
+	// Initialize cron jobs to reset all user usage, prune the sync change log, delete
+	// expired data exports and old undelivered pushes, anonymize accounts whose
+	// deletion grace period is over, summarize pushes deferred by quiet hours and email
+	// unread message digests. A job still running when its next run is due skips it,
+	// so that slow runs (e.g. many digests to send) don't overlap and repeat work.
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
 	c.AddFunc("3 0 * * *", controllers.ResetGPTUsage)
+	c.AddFunc("30 3 * * *", controllers.PruneChangeLog)
+	c.AddFunc("45 3 * * *", controllers.PruneExports)
+	c.AddFunc("50 3 * * *", controllers.PrunePushDeadLetters)
+	c.AddFunc("15 * * * *", controllers.ProcessAccountDeletions)
+	c.AddFunc("* * * * *", controllers.FlushDeferredPushes)
+	c.AddFunc("0 * * * *", controllers.SendEmailDigests)
 	c.Start()
 
 	// Start goroutines for handling WebSocket messages and persistence
@@ -35,6 +52,13 @@ func main() {
 	go controllers.HandleActions()
 	go controllers.HandlePersistence()
 	go controllers.HandleNotifications(context.Background())
+	go controllers.HandleEvents()
+	go controllers.HandleExports()
+
+	// Serve uploaded files (group photos...) when they are stored locally
+	if local, ok := services.FileStorage.(*services.LocalStorage); ok {
+		routes.Static("/uploads", local.Dir)
+	}
 
 	// WebSocket connection for real-time chat
 	routes.GET("/ws/:userId", controllers.HandleWebSocket)
@@ -46,32 +70,98 @@ func main() {
 	userRoutes := routes.Group("/users")
 	userRoutes.Use(middlewares.AuthMiddleware)
 	{
-		userRoutes.GET("/:username", controllers.GetUserByUsername) // Get user by username
-
-		userRoutes.GET("/me", controllers.GetAuthenticatedUser) // Get authenticated user
-		userRoutes.PUT("/me", controllers.UpdateUser)           // Update authenticated user
-		userRoutes.DELETE("/me", controllers.DeleteUser)        // Delete authenticated user
+		userRoutes.GET("/:username", controllers.GetUserByUsername)                                // Get user by username
+		userRoutes.GET("/search", middlewares.RateLimit(30, time.Minute), controllers.SearchUsers) // Search users by username or display name
+
+		userRoutes.GET("/me", controllers.GetAuthenticatedUser)           // Get authenticated user
+		userRoutes.PUT("/me", controllers.UpdateUser)                     // Update authenticated user
+		userRoutes.PATCH("/me", controllers.UpdateUser)                   // Partially update authenticated user
+		userRoutes.DELETE("/me", controllers.DeleteUser)                  // Delete authenticated user
+		userRoutes.POST("/me/export", controllers.RequestDataExport)      // Start an export of the user's data
+		userRoutes.GET("/me/export/:exportId", controllers.GetDataExport) // Poll the state of an export
+		userRoutes.PUT("/me/photo", controllers.UploadProfilePhoto)       // Upload a new profile photo
+		userRoutes.DELETE("/me/photo", controllers.DeleteProfilePhoto)    // Remove the profile photo
+
+		userRoutes.GET("/blocks", controllers.GetBlockedUsers)          // List users blocked by the authenticated user
+		userRoutes.POST("/blocks", controllers.BlockUser)               // Block a user
+		userRoutes.DELETE("/blocks/:username", controllers.UnblockUser) // Unblock a user
+
+		userRoutes.GET("/me/privacy", controllers.GetPrivacySettings)    // Get privacy settings
+		userRoutes.PUT("/me/privacy", controllers.UpdatePrivacySettings) // Update privacy settings
+
+		userRoutes.GET("/me/notifications", controllers.GetNotificationSettings)         // Get notification settings
+		userRoutes.PUT("/me/notifications", controllers.UpdateNotificationSettings)      // Update notification settings
+		userRoutes.PUT("/me/notifications/snooze", controllers.SnoozeNotifications)      // Pause notifications for some hours
+		userRoutes.DELETE("/me/notifications/snooze", controllers.UnsnoozeNotifications) // Resume notifications
+
+		userRoutes.GET("/me/notifications/schedules", controllers.GetQuietSchedules)                  // List quiet hours schedules
+		userRoutes.POST("/me/notifications/schedules", controllers.CreateQuietSchedule)               // Add a quiet hours schedule
+		userRoutes.PUT("/me/notifications/schedules/:scheduleId", controllers.UpdateQuietSchedule)    // Replace a quiet hours schedule
+		userRoutes.DELETE("/me/notifications/schedules/:scheduleId", controllers.DeleteQuietSchedule) // Delete a quiet hours schedule
+
+		userRoutes.PUT("/fcm", controllers.UpdateFCMToken)    // Register or refresh the push token of a device
+		userRoutes.DELETE("/fcm", controllers.DeleteFCMToken) // Unregister the push token of a device
+
+		userRoutes.GET("/me/devices", controllers.GetDevices)                 // List the devices the user is signed in on
+		userRoutes.DELETE("/me/devices/:deviceId", controllers.SignOutDevice) // Sign a device out remotely
+		userRoutes.POST("/me/devices/signout", controllers.SignOutEverywhere) // Sign out of every device
+	}
 
-		userRoutes.PUT("/fcm", controllers.UpdateFCMToken)
-		userRoutes.DELETE("/fcm", controllers.DeleteFCMToken)
+	// Contact routes
+	contactRoutes := routes.Group("/contacts")
+	contactRoutes.Use(middlewares.AuthMiddleware)
+	{
+		contactRoutes.GET("", controllers.GetContacts)                // List contacts
+		contactRoutes.DELETE("/:username", controllers.RemoveContact) // Remove a contact
+
+		contactRoutes.GET("/requests", controllers.GetFriendRequests)                       // List pending friend requests
+		contactRoutes.POST("/requests", controllers.SendFriendRequest)                      // Send a friend request
+		contactRoutes.PUT("/requests/:requestId/accept", controllers.AcceptFriendRequest)   // Accept a friend request
+		contactRoutes.PUT("/requests/:requestId/decline", controllers.DeclineFriendRequest) // Decline a friend request
+		contactRoutes.DELETE("/requests/:requestId", controllers.CancelFriendRequest)       // Cancel a sent friend request
 	}
 
+	// Download of a finished data export, authorized by the token in its link
+	routes.GET("/exports/:exportId", controllers.DownloadDataExport)
+
+	// Delta sync for offline-first clients
+	routes.GET("/sync", middlewares.AuthMiddleware, controllers.Sync)
+
 	// Chat routes
 	chatRoutes := routes.Group("/chats")
 	chatRoutes.Use(middlewares.AuthMiddleware)
 	{
-		chatRoutes.GET("/textfilters", controllers.GetTextFilters) // Get text filters
+		chatRoutes.GET("/textfilters", controllers.GetTextFilters)                // Get text filters
+		chatRoutes.POST("/textfilters", controllers.CreateTextFilter)             // Create a private or group text filter
+		chatRoutes.PUT("/textfilters/:filterId", controllers.UpdateTextFilter)    // Update a text filter
+		chatRoutes.DELETE("/textfilters/:filterId", controllers.DeleteTextFilter) // Delete a text filter
 
 		chatRoutes.GET("/summaries", controllers.GetChatSummaries) // Get all updated chats
 		chatRoutes.GET("/summaries/:chatId", controllers.GetSingleChatSummary)
-		chatRoutes.GET("/:chatId", controllers.GetChatDetails) // Get messages from a specific chat
-
-		chatRoutes.POST("/dm", controllers.CreateSingleChat) // Create a new chat
-
-		chatRoutes.POST("/group", controllers.CreateGroupChat)             // Create a new group chat
-		chatRoutes.POST("/group/:chatId", controllers.AddUsersToGroupChat) // Add new users to group chat
-		chatRoutes.PUT("/group/:chatId", controllers.UpdateGroupChatInfo)  // Update group chat info (name, photo?)
-		chatRoutes.PUT("/group/leave/:chatId", controllers.LeaveGroupChat) // Leave from group chat
+		chatRoutes.GET("/:chatId", controllers.GetChatDetails)                // Get messages from a specific chat
+		chatRoutes.PATCH("/:chatId/settings", controllers.UpdateChatSettings) // Mute, pin or archive a chat
+		chatRoutes.PUT("/pins", controllers.ReorderPinnedChats)               // Reorder pinned chats
+		chatRoutes.POST("/:chatId/clear", controllers.ClearChatHistory)       // Clear chat history for the current user
+
+		chatRoutes.POST("/dm", controllers.CreateSingleChat)           // Create a new chat
+		chatRoutes.DELETE("/dm/:chatId", controllers.DeleteSingleChat) // Delete a DM for the current user
+
+		chatRoutes.POST("/group", controllers.CreateGroupChat)                   // Create a new group chat
+		chatRoutes.POST("/group/:chatId", controllers.AddUsersToGroupChat)       // Add new users to group chat
+		chatRoutes.PUT("/group/:chatId", controllers.UpdateGroupChatInfo)        // Update group chat info (name, description)
+		chatRoutes.PUT("/group/:chatId/photo", controllers.UploadGroupChatPhoto) // Upload a new group photo
+		chatRoutes.PUT("/group/leave/:chatId", controllers.LeaveGroupChat)       // Leave from group chat
+		chatRoutes.DELETE("/group/:chatId", controllers.DeleteGroupChat)         // Delete group chat (owner)
+
+		chatRoutes.POST("/group/:chatId/invites", controllers.CreateGroupInvite)             // Create an invite link (admins)
+		chatRoutes.GET("/group/:chatId/invites", controllers.GetGroupInvites)                // List active invite links (admins)
+		chatRoutes.DELETE("/group/:chatId/invites/:inviteId", controllers.RevokeGroupInvite) // Revoke an invite link (admins)
+		chatRoutes.GET("/invites/:code", controllers.GetInvitePreview)                       // Preview the group behind an invite
+		chatRoutes.POST("/invites/:code/join", controllers.JoinGroupByInvite)                // Join (or request to join) via invite
+
+		chatRoutes.GET("/group/:chatId/requests", controllers.GetJoinRequests)                     // List pending join requests (admins)
+		chatRoutes.PUT("/group/:chatId/requests/:requestId/accept", controllers.AcceptJoinRequest) // Accept a join request (admins)
+		chatRoutes.PUT("/group/:chatId/requests/:requestId/reject", controllers.RejectJoinRequest) // Reject a join request (admins)
 	}
 
 	routes.Run(":8080")
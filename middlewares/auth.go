@@ -41,6 +41,18 @@ func AuthMiddleware(c *gin.Context) {
 	err = services.DB.Where("id = ?", token.UID).Find(&user).Error
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Deleted accounts are gone for good; accounts pending deletion are disabled until
+	// their owner logs in again, which cancels the deletion
+	if user.AnonymizedAt != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "This account was deleted"})
+		return
+	}
+	if user.DeletionRequestedAt != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This account is scheduled for deletion, log in again to cancel it"})
+		return
 	}
 
 	c.Set("currentUser", user)
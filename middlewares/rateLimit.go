@@ -0,0 +1,63 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shogoshima/divertidachat-backend/models"
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimit allows each authenticated user at most limit requests per window on the
+// routes it guards. It must run after AuthMiddleware. Counters live in memory, so the
+// limit applies per server instance.
+func RateLimit(limit int, window time.Duration) gin.HandlerFunc {
+	var (
+		mu      sync.Mutex
+		windows = make(map[string]*rateWindow)
+		swept   = time.Now()
+	)
+
+	return func(c *gin.Context) {
+		user, _ := c.Get("currentUser")
+		CurrentUser := user.(models.User)
+
+		now := time.Now()
+
+		mu.Lock()
+		// Forget users whose window is over, so the map doesn't grow forever
+		if now.Sub(swept) > window {
+			for id, w := range windows {
+				if now.Sub(w.start) > window {
+					delete(windows, id)
+				}
+			}
+			swept = now
+		}
+
+		w, ok := windows[CurrentUser.ID]
+		if !ok || now.Sub(w.start) > window {
+			w = &rateWindow{start: now}
+			windows[CurrentUser.ID] = w
+		}
+		w.count++
+		allowed := w.count <= limit
+		retryAfter := w.start.Add(window).Sub(now)
+		mu.Unlock()
+
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+			return
+		}
+
+		c.Next()
+	}
+}
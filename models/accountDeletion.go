@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States of an account deletion
+const (
+	AccountDeletionScheduled = "scheduled"
+	AccountDeletionCancelled = "cancelled"
+	AccountDeletionCompleted = "completed"
+)
+
+// AccountDeletion is the audit record of an account deletion request and its outcome.
+// It only keeps the user ID, no personal data.
+// For the database
+type AccountDeletion struct {
+	ID           uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID       string     `json:"user_id" gorm:"not null;index"`
+	Status       string     `json:"status" gorm:"not null;default:scheduled"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	CancelledAt  *time.Time `json:"cancelled_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+
+	// What the anonymization did
+	DMsDeleted         int   `json:"dms_deleted"`
+	GroupsLeft         int   `json:"groups_left"`
+	MessagesAnonymized int64 `json:"messages_anonymized"`
+	SessionsRevoked    bool  `json:"sessions_revoked"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// Block means BlockerID doesn't want any contact with BlockedID.
+// For the database
+type Block struct {
+	BlockerID string    `json:"blocker_id" gorm:"primaryKey"`
+	BlockedID string    `json:"blocked_id" gorm:"primaryKey;index"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	Blocker User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	Blocked User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
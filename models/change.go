@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Entities tracked in the change log
+const (
+	ChangeEntityMessage = "message"
+	ChangeEntityChat    = "chat"
+	ChangeEntityMember  = "member" // EntityID is the user ID, ChatID the chat
+	ChangeEntityUser    = "user"
+)
+
+// Operations recorded in the change log
+const (
+	ChangeOpUpsert = "upsert"
+	ChangeOpDelete = "delete"
+)
+
+// Change is an entry of the change log that clients sync from.
+// It only references the entity; its current state is loaded when syncing.
+// Changes with ChatID are visible to the chat members, changes with UserID to that user
+// (and, for user changes, to everyone sharing a chat with them).
+// For the database
+type Change struct {
+	ID int64 `gorm:"primaryKey;autoIncrement;index:idx_changes_position,priority:2"`
+	// Transaction that wrote the change, which orders the log (see services.SyncHorizon)
+	TxID      int64      `gorm:"not null;default:(pg_current_xact_id()::text::bigint);index:idx_changes_position,priority:1"`
+	ChatID    *uuid.UUID `gorm:"type:uuid;index"`
+	UserID    *string    `gorm:"index"`
+	Entity    string     `gorm:"not null"`
+	EntityID  string     `gorm:"not null"`
+	Op        string     `gorm:"not null"`
+	CreatedAt time.Time  `gorm:"autoCreateTime;index"`
+}
@@ -16,6 +16,9 @@ type Chat struct {
 	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime"`
 	ChatPhoto string    `json:"chat_photo"`
 
+	// Group description / topic
+	Description string `json:"description"`
+
 	Messages  []Message  `gorm:"constraint:OnDelete:CASCADE;"`
 	ChatUsers []ChatUser `gorm:"constraint:OnDelete:CASCADE;"`
 }
\ No newline at end of file
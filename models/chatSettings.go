@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// ChatSettings are the per-user preferences for a chat.
+// Stored in the ChatUser table and sent to the frontend in ChatSummary
+type ChatSettings struct {
+	MutedUntil   *time.Time `json:"muted_until"`
+	MutedForever bool       `json:"muted_forever" gorm:"default:false"`
+	PinOrder     *int       `json:"pin_order"` // nil when not pinned, pinned chats are sorted ascending
+	Archived     bool       `json:"archived" gorm:"default:false"`
+	KeepArchived bool       `json:"keep_archived" gorm:"default:false"` // Don't unarchive on new messages
+}
+
+// IsMuted reports whether notifications for the chat are silenced at the given time
+func (s ChatSettings) IsMuted(now time.Time) bool {
+	return s.MutedForever || (s.MutedUntil != nil && now.Before(*s.MutedUntil))
+}
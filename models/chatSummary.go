@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -9,6 +11,15 @@ type ChatSummary struct {
 	ChatID      uuid.UUID `json:"chat_id"`
 	ChatName    string    `json:"chat_name"`
 	IsGroup     bool      `json:"is_group"`
-	ChatPhoto   string   `json:"chat_photo"`
+	ChatPhoto   string    `json:"chat_photo"`
+	Description string    `json:"description"`
 	LastMessage *string   `json:"last_message"`
+
+	LastMessageSenderID *string    `json:"last_message_sender_id"`
+	LastMessageAt       *time.Time `json:"last_message_at"`
+	LastMessageKind     *string    `json:"last_message_kind"`
+
+	LastReadAt *time.Time `json:"last_read_at"`
+
+	Settings ChatSettings `json:"settings"`
 }
@@ -6,13 +6,35 @@ import (
 	"github.com/google/uuid"
 )
 
+// Roles a user can have inside a group chat
+const (
+	ChatRoleOwner  = "owner"
+	ChatRoleAdmin  = "admin"
+	ChatRoleMember = "member"
+)
+
 // ChatUser is the join table that connects Users and Chats.
 // For the database
 type ChatUser struct {
 	ChatID   uuid.UUID `json:"chat_id" gorm:"type:uuid;primaryKey"`
 	UserID   string    `json:"user_id" gorm:"primaryKey"`
+	Role     string    `json:"role" gorm:"not null;default:member"`
 	JoinedAt time.Time `json:"joined_at" gorm:"autoCreateTime"`
 
+	ChatSettings `gorm:"embedded"`
+
+	// Messages sent up to this time are hidden from this user ("clear history")
+	ClearedAt *time.Time `json:"cleared_at"`
+	// Messages sent up to this time have been read by this user
+	LastReadAt *time.Time `json:"last_read_at"`
+	// A DM deleted by this user, hidden until a new message arrives
+	Hidden bool `json:"hidden" gorm:"default:false"`
+
 	Chat Chat `gorm:"constraint:OnDelete:CASCADE;"`
 	User User `gorm:"constraint:OnDelete:CASCADE;"`
 }
+
+// IsAdmin reports whether the member can manage the group (invites, join requests)
+func (cu ChatUser) IsAdmin() bool {
+	return cu.Role == ChatRoleOwner || cu.Role == ChatRoleAdmin
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Possible states of a friend request
+const (
+	FriendRequestPending  = "pending"
+	FriendRequestAccepted = "accepted"
+	FriendRequestDeclined = "declined"
+)
+
+// Contact links two users who accepted each other; there is one row per direction.
+// For the database
+type Contact struct {
+	UserID    string    `json:"user_id" gorm:"primaryKey"`
+	ContactID string    `json:"contact_id" gorm:"primaryKey;index"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	User        User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	ContactUser User `json:"-" gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE;"`
+}
+
+// FriendRequest asks ToID to become a contact of FromID.
+// For the database
+type FriendRequest struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	FromID      string     `json:"from_id" gorm:"not null;uniqueIndex:idx_pending_friend_request,where:status = 'pending'"`
+	ToID        string     `json:"to_id" gorm:"not null;index;uniqueIndex:idx_pending_friend_request,where:status = 'pending'"`
+	Status      string     `json:"status" gorm:"not null;default:pending"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	RespondedAt *time.Time `json:"responded_at"`
+
+	From User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	To   User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
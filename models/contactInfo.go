@@ -0,0 +1,15 @@
+package models
+
+// For communication with the frontend
+// A contact along with their presence
+type ContactInfo struct {
+	PublicProfile
+	Online bool `json:"online"`
+}
+
+// For communication with the frontend
+type FriendRequestInfo struct {
+	FriendRequest
+	From PublicProfile `json:"from"`
+	To   PublicProfile `json:"to"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeferredPush counts the messages of a chat that weren't pushed to a user because of
+// quiet hours, to summarize them once quiet hours are over.
+// For the database
+type DeferredPush struct {
+	UserID string    `gorm:"primaryKey"`
+	ChatID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	Count  int       `gorm:"not null;default:0"`
+	LastAt time.Time // When the last message was deferred
+
+	User User `gorm:"constraint:OnDelete:CASCADE;"`
+	Chat Chat `gorm:"constraint:OnDelete:CASCADE;"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Platforms a device can report
+const (
+	PlatformAndroid = "android"
+	PlatformIOS     = "ios"
+	PlatformWeb     = "web"
+	PlatformUnknown = "unknown"
+)
+
+// Device is an app installation of a user that receives push notifications.
+// For the database
+type Device struct {
+	ID           uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID       string    `json:"-" gorm:"not null;index"`
+	Token        string    `json:"-" gorm:"not null;uniqueIndex"` // FCM registration token
+	Platform     string    `json:"platform" gorm:"not null;default:unknown"`
+	AppVersion   string    `json:"app_version"`
+	Name         string    `json:"name"` // e.g. the phone model, shown in the devices list
+	LastActiveAt time.Time `json:"last_active_at"`
+	CreatedAt    time.Time `json:"created_at" gorm:"autoCreateTime"`
+
+	User User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+// ValidPlatform reports whether p is one of the known platforms
+func ValidPlatform(p string) bool {
+	return p == PlatformAndroid || p == PlatformIOS || p == PlatformWeb || p == PlatformUnknown
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// States of an export job
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+	ExportExpired = "expired" // The archive was deleted
+)
+
+// ExportJob builds an archive with a user's data in the background.
+// For the database
+type ExportJob struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID     string     `json:"-" gorm:"not null;index"`
+	Status     string     `json:"status" gorm:"not null;default:pending;index"`
+	IncludeDMs bool       `json:"include_dms"` // All messages of the user's DMs, not only their own
+	Error      string     `json:"error,omitempty"`
+	FileKey    string     `json:"-"`
+	Token      string     `json:"-"` // Secret of the download link
+	Size       int64      `json:"size,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	FinishedAt *time.Time `json:"finished_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+
+	User User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
@@ -3,5 +3,8 @@ package models
 // For the Firebase Cloud Messaging
 // Communication with the frontend
 type FCMToken struct {
-	Token string `json:"fcm_token"`
+	Token      string `json:"fcm_token" binding:"required"`
+	Platform   string `json:"platform"`
+	AppVersion string `json:"app_version"`
+	Name       string `json:"name"`
 }
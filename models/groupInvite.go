@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GroupInvite is a shareable link that lets users join a group chat.
+// For the database
+type GroupInvite struct {
+	ID               uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ChatID           uuid.UUID  `json:"chat_id" gorm:"type:uuid;index;not null"`
+	Code             string     `json:"code" gorm:"uniqueIndex;not null"`
+	CreatedBy        string     `json:"created_by"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	MaxUses          int        `json:"max_uses" gorm:"default:0"` // 0 means unlimited
+	Uses             int        `json:"uses" gorm:"default:0"`
+	RequiresApproval bool       `json:"requires_approval" gorm:"default:false"`
+	RevokedAt        *time.Time `json:"revoked_at"`
+	CreatedAt        time.Time  `json:"created_at" gorm:"autoCreateTime"`
+
+	Chat Chat `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+// Usable reports whether the invite can still be used to join at the given time
+func (i GroupInvite) Usable(now time.Time) bool {
+	if i.RevokedAt != nil {
+		return false
+	}
+	if i.ExpiresAt != nil && now.After(*i.ExpiresAt) {
+		return false
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return false
+	}
+	return true
+}
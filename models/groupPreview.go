@@ -0,0 +1,16 @@
+package models
+
+import (
+	"github.com/google/uuid"
+)
+
+// For communication with the frontend
+// Shown to a user who opened an invite link, before joining
+type GroupPreview struct {
+	ChatID           uuid.UUID `json:"chat_id"`
+	ChatName         string    `json:"chat_name"`
+	ChatPhoto        string    `json:"chat_photo"`
+	MemberCount      int64     `json:"member_count"`
+	RequiresApproval bool      `json:"requires_approval"`
+	IsMember         bool      `json:"is_member"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Possible states of a join request
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestAccepted = "accepted"
+	JoinRequestRejected = "rejected"
+)
+
+// JoinRequest is a request to join a group through an invite that requires approval.
+// For the database
+type JoinRequest struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ChatID     uuid.UUID  `json:"chat_id" gorm:"type:uuid;index;not null"`
+	UserID     string     `json:"user_id" gorm:"index;not null"`
+	InviteID   uuid.UUID  `json:"invite_id" gorm:"type:uuid"`
+	Status     string     `json:"status" gorm:"not null;default:pending"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	ResolvedBy *string    `json:"resolved_by"`
+
+	Chat Chat `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	User User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
@@ -6,13 +6,20 @@ import (
 	"github.com/google/uuid"
 )
 
+// Kinds of message
+const (
+	MessageKindText     = "text"
+	MessageKindFiltered = "filtered" // Rewritten by a text filter
+)
+
 // Message represents an individual message within a chat.
 // For the database
 type Message struct {
 	ID       uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
-	ChatID   uuid.UUID `json:"chat_id" gorm:"type:uuid"`
+	ChatID   uuid.UUID `json:"chat_id" gorm:"type:uuid;index:idx_messages_chat_sent,priority:1"`
 	SenderID string    `json:"sender_id"`
 	Text     string    `json:"text"`
-	SentAt   time.Time `json:"sent_at" gorm:"autoCreateTime"`
+	Kind     string    `json:"kind" gorm:"not null;default:text"`
+	SentAt   time.Time `json:"sent_at" gorm:"autoCreateTime;index:idx_messages_chat_sent,priority:2,sort:desc"`
 	Seen     bool      `json:"seen" gorm:"default:false"`
 }
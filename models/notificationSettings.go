@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+)
+
+// How often the unread messages digest is emailed
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// NotificationSettings control the push notifications a user gets.
+// Stored in the User table
+type NotificationSettings struct {
+	HideContent bool `json:"hide_content" gorm:"default:false"` // Don't show message text in notifications
+
+	// Notifications are paused until then ("snooze"), on top of the quiet schedules
+	SnoozedUntil *time.Time `json:"snoozed_until"`
+	// What still notifies during quiet hours and snoozes
+	QuietAllowDMs      bool `json:"quiet_allow_dms" gorm:"default:false"`
+	QuietAllowMentions bool `json:"quiet_allow_mentions" gorm:"default:true"`
+	// Summarize the messages that weren't notified once quiet hours are over
+	QuietSummary bool `json:"quiet_summary" gorm:"default:true"`
+
+	// Opt-in email summarizing unread messages
+	DigestFrequency string     `json:"digest_frequency" gorm:"not null;default:off"`
+	DigestSentAt    *time.Time `json:"-"`
+}
+
+// ValidDigestFrequency reports whether f is one of the digest frequencies
+func ValidDigestFrequency(f string) bool {
+	return f == DigestOff || f == DigestDaily || f == DigestWeekly
+}
+
+// DigestPeriod is the time between two digests, zero when they are off
+func (s NotificationSettings) DigestPeriod() time.Duration {
+	switch s.DigestFrequency {
+	case DigestDaily:
+		return 24 * time.Hour
+	case DigestWeekly:
+		return 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// IsSnoozed reports whether notifications are snoozed at the given time
+func (s NotificationSettings) IsSnoozed(now time.Time) bool {
+	return s.SnoozedUntil != nil && now.Before(*s.SnoozedUntil)
+}
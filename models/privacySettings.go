@@ -0,0 +1,22 @@
+package models
+
+// Who can see a piece of the user's profile
+const (
+	VisibilityEveryone = "everyone"
+	VisibilityContacts = "contacts"
+	VisibilityNobody   = "nobody"
+)
+
+// PrivacySettings control what other users can see of a user and do with them.
+// Stored in the User table
+type PrivacySettings struct {
+	ContactsOnly       bool   `json:"contacts_only" gorm:"default:false"` // Only contacts can start a DM or add the user to groups
+	LastSeenVisibility string `json:"last_seen_visibility" gorm:"not null;default:everyone"`
+	OnlineVisibility   string `json:"online_visibility" gorm:"not null;default:everyone"`
+	PhotoVisibility    string `json:"photo_visibility" gorm:"not null;default:everyone"`
+}
+
+// ValidVisibility reports whether v is one of the visibility values
+func ValidVisibility(v string) bool {
+	return v == VisibilityEveryone || v == VisibilityContacts || v == VisibilityNobody
+}
@@ -10,5 +10,6 @@ type PublicProfile struct {
 	DisplayName string     `json:"display_name"`
 	Username    string     `json:"username"`
 	PhotoURL    string     `json:"photo_url"`
+	Bio         string     `json:"bio"`
 	LastSeen    *time.Time `json:"last_seen"`
 }
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// PushDeadLetter is a push notification that couldn't be delivered, kept for
+// inspection (and replay) instead of being silently dropped.
+// For the database
+type PushDeadLetter struct {
+	ID        int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	Token     string    `json:"-" gorm:"not null"`
+	Payload   string    `json:"payload" gorm:"type:jsonb"` // The notification and data sent
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime;index"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QuietSchedule is a recurring do-not-disturb period of a user: from StartMinute to
+// EndMinute (minutes since midnight, in Timezone) on the given days. A period ending
+// before it starts runs overnight, into the next day.
+// For the database
+type QuietSchedule struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      string    `json:"-" gorm:"not null;index"`
+	Days        int       `json:"-" gorm:"not null"` // Bitmask of weekdays, bit 0 is Sunday
+	StartMinute int       `json:"-" gorm:"not null"`
+	EndMinute   int       `json:"-" gorm:"not null"`
+	Timezone    string    `json:"-" gorm:"not null;default:UTC"`
+	CreatedAt   time.Time `json:"-" gorm:"autoCreateTime"`
+
+	User User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+// HasDay reports whether the schedule starts on the weekday
+func (s QuietSchedule) HasDay(day time.Weekday) bool {
+	return s.Days&(1<<day) != 0
+}
+
+// Active reports whether the schedule is silencing notifications at the given time
+func (s QuietSchedule) Active(now time.Time) bool {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	switch {
+	case s.StartMinute == s.EndMinute: // The whole day
+		return s.HasDay(today)
+	case s.StartMinute < s.EndMinute:
+		return s.HasDay(today) && minute >= s.StartMinute && minute < s.EndMinute
+	default: // Overnight, started today or yesterday
+		return (s.HasDay(today) && minute >= s.StartMinute) || (s.HasDay(yesterday) && minute < s.EndMinute)
+	}
+}
+
+// For communication with the frontend
+type QuietScheduleInfo struct {
+	ID       uuid.UUID `json:"id"`
+	Days     []int     `json:"days"`  // Weekdays, 0 is Sunday
+	Start    string    `json:"start"` // HH:MM
+	End      string    `json:"end"`   // HH:MM
+	Timezone string    `json:"timezone"`
+}
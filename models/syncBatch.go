@@ -0,0 +1,28 @@
+package models
+
+import (
+	"github.com/google/uuid"
+)
+
+// For communication with the frontend
+// Everything that changed since the sync token the client sent
+type SyncBatch struct {
+	Token   string `json:"token"`
+	HasMore bool   `json:"has_more"`
+
+	Messages        []Message       `json:"messages"`
+	DeletedMessages []uuid.UUID     `json:"deleted_messages"`
+	Chats           []ChatSummary   `json:"chats"`
+	DeletedChats    []uuid.UUID     `json:"deleted_chats"`
+	Members         []SyncMember    `json:"members"`
+	RemovedMembers  []SyncMember    `json:"removed_members"`
+	Profiles        []PublicProfile `json:"profiles"`
+	DeletedProfiles []string        `json:"deleted_profiles"`
+}
+
+// A chat membership, as sent in SyncBatch
+type SyncMember struct {
+	ChatID uuid.UUID `json:"chat_id"`
+	UserID string    `json:"user_id"`
+	Role   string    `json:"role,omitempty"`
+}
@@ -1,9 +1,31 @@
 package models
 
-// For communicating with the frontend
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Who can use a text filter
+const (
+	TextFilterSystem  = "system"  // Built in, available to everyone
+	TextFilterPrivate = "private" // Only its creator
+	TextFilterGroup   = "group"   // The members of a group chat
+)
+
+// TextFilter rewrites messages with an LLM, following Command.
+// For the database and communication with the frontend
 type TextFilter struct {
-	ID      int    `json:"id"`
-	Name    string `json:"name"`
-	Emoji   string `json:"emoji"`
-	Command string `json:"command"`
+	ID        int        `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string     `json:"name" gorm:"not null"`
+	Emoji     string     `json:"emoji" gorm:"not null"`
+	Command   string     `json:"command" gorm:"not null"`
+	Scope     string     `json:"scope" gorm:"not null;default:system;index"`
+	OwnerID   *string    `json:"owner_id,omitempty" gorm:"index"`          // Creator of private and group filters
+	ChatID    *uuid.UUID `json:"chat_id,omitempty" gorm:"type:uuid;index"` // Group of group filters
+	CreatedAt time.Time  `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt time.Time  `json:"updated_at" gorm:"autoUpdateTime"`
+
+	Owner *User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	Chat  *Chat `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
 }
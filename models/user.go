@@ -12,7 +12,20 @@ type User struct {
 	Username    string     `json:"username" gorm:"uniqueIndex;not null"`
 	Email       string     `json:"email" gorm:"uniqueIndex;not null"`
 	PhotoURL    string     `json:"photo_url"`
+	Bio         string     `json:"bio"`
 	LastSeen    *time.Time `json:"last_seen"`
 	UsedTokens  int        `json:"used_tokens" gorm:"default:0"`
-	FCMToken    *string    `json:"fcm_token"`
+
+	// Set once the user edits them, so logging in doesn't overwrite them with the provider's
+	CustomDisplayName bool `json:"-" gorm:"default:false"`
+	CustomPhoto       bool `json:"-" gorm:"default:false"`
+
+	PrivacySettings      `gorm:"embedded"`
+	NotificationSettings `gorm:"embedded"`
+
+	// Deletion: a requested deletion disables the account until DeleteAfter (logging in
+	// cancels it), then the account is anonymized
+	DeletionRequestedAt *time.Time `json:"-"`
+	DeleteAfter         *time.Time `json:"-" gorm:"index"`
+	AnonymizedAt        *time.Time `json:"-"`
 }
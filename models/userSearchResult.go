@@ -0,0 +1,8 @@
+package models
+
+// For communication with the frontend
+// A user found by search. Last seen is left out: search reaches strangers too.
+type UserSearchResult struct {
+	PublicProfile
+	IsContact bool `json:"is_contact"`
+}
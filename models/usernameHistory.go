@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// UsernameHistory remembers a username a user had before renaming, so lookups of the
+// old name can lead to them.
+// For the database
+type UsernameHistory struct {
+	Username  string    `json:"username" gorm:"primaryKey"`
+	UserID    string    `json:"user_id" gorm:"not null;index"`
+	ChangedAt time.Time `json:"changed_at" gorm:"autoCreateTime"`
+
+	User User `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
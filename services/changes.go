@@ -0,0 +1,34 @@
+package services
+
+import (
+	"time"
+
+	"github.com/shogoshima/divertidachat-backend/models"
+	"gorm.io/gorm"
+)
+
+// How long the change log is kept; clients that haven't synced for longer must resync fully
+const ChangeRetention = 30 * 24 * time.Hour
+
+// RecordChanges appends entries to the change log used by delta sync.
+// Pass the transaction when the change is part of one, so both commit together.
+func RecordChanges(db *gorm.DB, changes ...models.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return db.Create(&changes).Error
+}
+
+// SyncHorizon returns the oldest transaction that may still be running. Every change
+// written by an older transaction is committed (or rolled back) already, so the log
+// can be read up to the horizon without ever missing a change that commits later.
+func SyncHorizon(db *gorm.DB) (int64, error) {
+	var horizon int64
+	err := db.Raw("SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint").Scan(&horizon).Error
+	return horizon, err
+}
+
+// PruneChanges deletes change log entries older than ChangeRetention
+func PruneChanges() error {
+	return DB.Where("created_at < ?", time.Now().Add(-ChangeRetention)).Delete(&models.Change{}).Error
+}
@@ -40,9 +40,93 @@ func InitializeDB() error {
 		&models.Chat{},
 		&models.ChatUser{},
 		&models.Message{},
+		&models.GroupInvite{},
+		&models.JoinRequest{},
+		&models.Change{},
+		&models.Block{},
+		&models.Contact{},
+		&models.FriendRequest{},
+		&models.UsernameHistory{},
+		&models.ExportJob{},
+		&models.AccountDeletion{},
+		&models.Device{},
+		&models.PushDeadLetter{},
+		&models.QuietSchedule{},
+		&models.DeferredPush{},
+		&models.TextFilter{},
 	); err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
+	if err := promoteGroupOwners(); err != nil {
+		return fmt.Errorf("failed to promote group owners: %w", err)
+	}
+
+	if err := migrateFCMTokens(); err != nil {
+		return fmt.Errorf("failed to migrate FCM tokens: %w", err)
+	}
+
+	if err := seedTextFilters(); err != nil {
+		return fmt.Errorf("failed to seed text filters: %w", err)
+	}
+
+	if err := createSearchIndexes(); err != nil {
+		return fmt.Errorf("failed to create search indexes: %w", err)
+	}
+
+	return nil
+}
+
+// promoteGroupOwners makes the earliest member the owner of any group that has none,
+// which is the case for groups created before roles existed.
+func promoteGroupOwners() error {
+	return DB.Exec(`
+		UPDATE chat_users cu SET role = ?
+		FROM (
+			SELECT DISTINCT ON (chat_users.chat_id) chat_users.chat_id, chat_users.user_id
+			FROM chat_users
+			JOIN chats ON chats.id = chat_users.chat_id
+			WHERE chats.is_group = true AND NOT EXISTS (
+				SELECT 1 FROM chat_users o WHERE o.chat_id = chat_users.chat_id AND o.role = ?
+			)
+			ORDER BY chat_users.chat_id, chat_users.joined_at
+		) first
+		WHERE cu.chat_id = first.chat_id AND cu.user_id = first.user_id
+	`, models.ChatRoleOwner, models.ChatRoleOwner).Error
+}
+
+// migrateFCMTokens moves the single FCM token users used to have into the devices
+// table, then drops the old column
+func migrateFCMTokens() error {
+	if !DB.Migrator().HasColumn(&models.User{}, "fcm_token") {
+		return nil
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`
+			INSERT INTO devices (user_id, token, platform, last_active_at)
+			SELECT id, fcm_token, ?, COALESCE(last_seen, now()) FROM users
+			WHERE fcm_token IS NOT NULL AND fcm_token <> ''
+			ON CONFLICT (token) DO NOTHING
+		`, models.PlatformUnknown).Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&models.User{}, "fcm_token")
+	})
+}
+
+// createSearchIndexes adds the indexes used by user search, which gorm tags can't
+// express: trigram matching on display names and prefix matching on usernames.
+func createSearchIndexes() error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS idx_users_display_name_trgm ON users USING gin (lower(display_name) gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_username_prefix ON users (lower(username) text_pattern_ops)`,
+	}
+	for _, stmt := range statements {
+		if err := DB.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// jpegOrientation reads the EXIF orientation (1 to 8) of a JPEG file. Phones store
+// photos unrotated and record how to display them there; 1 (as stored) is returned
+// when the file has no orientation or isn't a JPEG.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		// Image data starts at SOS; EXIF always comes before it
+		if marker == 0xDA || length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+
+	return 1
+}
+
+// tiffOrientation finds the orientation tag in the first IFD of a TIFF header
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+
+	return 1
+}
+
+// orientSquare applies an EXIF orientation to a square image, so it displays upright.
+// A centered square crop of the oriented photo is the oriented crop of the stored one,
+// so orienting after cropping and resizing gives the same result for less work.
+func orientSquare(img image.Image, orientation int) image.Image {
+	if orientation == 1 {
+		return img
+	}
+
+	b := img.Bounds()
+	n := b.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			// Source pixel shown at (x, y)
+			sx, sy := x, y
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx = n - 1 - x
+			case 3: // Rotated 180°
+				sx, sy = n-1-x, n-1-y
+			case 4: // Mirrored vertically
+				sy = n - 1 - y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Needs a 90° clockwise rotation
+				sx, sy = y, n-1-x
+			case 7: // Transversed
+				sx, sy = n-1-y, n-1-x
+			case 8: // Needs a 90° counter-clockwise rotation
+				sx, sy = n-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
@@ -29,7 +29,10 @@ func InitFirebase() error {
 		return err
 	}
 
-	// Initialize Messaging client once
+	// Initialize Messaging client once, only needed to send pushes through FCM
+	if PushProviderName() != "fcm" {
+		return nil
+	}
 	MessagingClient, err = app.Messaging(context.Background())
 	if err != nil {
 		return err
@@ -1,87 +1,64 @@
 package services
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
-	"os"
 
 	"github.com/shogoshima/divertidachat-backend/models"
+	"gorm.io/gorm"
 )
 
-var apiKey = os.Getenv("OPENAI_API_KEY")
-
-const apiUrl = "https://api.openai.com/v1/chat/completions"
-
-func GetGPTResponse(messages []models.GPTMessage, senderId string) (string, error) {
-	if apiKey == "" {
-		return "", fmt.Errorf("OpenAI API key is not set")
-	}
-
-	user, err := fetchUser(senderId)
-	if err != nil {
-		return "", fmt.Errorf("failed to fetch user: %w", err)
-	}
-
-	if user.UsedTokens > 5000 {
-		return "", fmt.Errorf("user has exceeded their token limit, try again tomorrow")
-	}
-
-	requestBody, err := json.Marshal(models.GPTRequest{
-		Model:    "gpt-4o-mini",
-		Messages: messages,
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal GPT request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
+const (
+	dailyTokenLimit  = 5000 // Tokens a user can use per day
+	tokenReservation = 500  // Tokens set aside for a call until its actual usage is known
+)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+// ErrTokenLimitExceeded is returned when the user has used up their tokens for the day
+var ErrTokenLimitExceeded = errors.New("user has exceeded their token limit, try again tomorrow")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to call OpenAI: %w", err)
+// GetGPTResponse answers the messages with the model (the provider's default when
+// empty), counting the tokens used against the sender's daily limit
+func GetGPTResponse(ctx context.Context, model string, messages []models.GPTMessage, senderId string) (string, error) {
+	// Tokens are reserved before the call, so concurrent calls can't all pass the check
+	if err := reserveTokens(senderId); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	completion, err := LLM.Complete(ctx, model, messages)
 	if err != nil {
-		return "", fmt.Errorf("failed to read OpenAI response: %w", err)
+		if refundErr := addUsedTokens(senderId, -tokenReservation); refundErr != nil {
+			fmt.Println("Failed to refund reserved tokens:", refundErr)
+		}
+		return "", err
 	}
 
-	var gptResponse models.GPTResponse
-	if err := json.Unmarshal(body, &gptResponse); err != nil {
-		return "", fmt.Errorf("failed to unmarshal GPT response: %w", err)
-	}
-
-	if len(gptResponse.Choices) == 0 {
-		return "", fmt.Errorf("no choices returned from GPT")
-	}
-
-	newUsedTokens := user.UsedTokens + gptResponse.Usage.TotalTokens
-	if err := updateUserTokenUsage(senderId, newUsedTokens); err != nil {
+	if err := addUsedTokens(senderId, completion.TotalTokens-tokenReservation); err != nil {
 		return "", fmt.Errorf("failed to update user's token usage: %w", err)
 	}
 
-	return gptResponse.Choices[0].Message.Content, nil
+	return completion.Content, nil
 }
 
-// fetchUser retrieves the user from the DB
-func fetchUser(id string) (*models.User, error) {
-	var user models.User
-	err := DB.Model(&user).Where("id = ?", id).First(&user).Error
-	return &user, err
+// reserveTokens sets tokens aside for a call of the user, if they haven't reached
+// their daily limit
+func reserveTokens(id string) error {
+	result := DB.Model(&models.User{}).
+		Where("id = ? AND used_tokens <= ?", id, dailyTokenLimit).
+		UpdateColumn("used_tokens", gorm.Expr("used_tokens + ?", tokenReservation))
+	if result.Error != nil {
+		return fmt.Errorf("failed to reserve tokens: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTokenLimitExceeded
+	}
+	return nil
 }
 
-// updateUserTokenUsage updates the user's used token count
-func updateUserTokenUsage(id string, tokens int) error {
-	return DB.Model(&models.User{}).Where("id = ?", id).Update("used_tokens", tokens).Error
+// addUsedTokens adds (or, when negative, removes) tokens to the user's usage. The
+// usage may have been reset since the tokens were reserved, so it never goes below 0.
+func addUsedTokens(id string, tokens int) error {
+	return DB.Model(&models.User{}).
+		Where("id = ?", id).
+		UpdateColumn("used_tokens", gorm.Expr("GREATEST(used_tokens + ?, 0)", tokens)).Error
 }
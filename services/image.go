@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	// Register the formats accepted for uploads
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	MaxImageUploadSize = 10 << 20 // 10 MB
+	maxImagePixels     = 40_000_000
+	minImageSide       = 64
+)
+
+var ErrInvalidImage = errors.New("file is not a supported image (jpeg, png or gif)")
+
+// ProcessSquareImage decodes an uploaded image, crops it to a centered square and
+// returns one JPEG per requested size, upright according to its EXIF orientation.
+// Re-encoding drops any metadata (EXIF, comments) the original file carried.
+func ProcessSquareImage(r io.Reader, sizes ...int) (map[int][]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxImageUploadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(data) > MaxImageUploadSize {
+		return nil, fmt.Errorf("image is larger than %d MB", MaxImageUploadSize>>20)
+	}
+
+	// Check the dimensions before decoding, so huge images can't exhaust memory
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d are too large", config.Width, config.Height)
+	}
+	if config.Width < minImageSide || config.Height < minImageSide {
+		return nil, fmt.Errorf("image must be at least %dx%d pixels", minImageSide, minImageSide)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	square := cropSquare(img)
+	orientation := jpegOrientation(data)
+
+	out := make(map[int][]byte, len(sizes))
+	for _, size := range sizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, orientSquare(resize(square, size), orientation), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %w", err)
+		}
+		out[size] = buf.Bytes()
+	}
+
+	return out, nil
+}
+
+// cropSquare returns the largest centered square of img
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	rect := image.Rect(x0, y0, x0+side, y0+side)
+
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			dst.Set(x, y, img.At(x0+x, y0+y))
+		}
+	}
+	return dst
+}
+
+// resize scales a square image to size x size. Each destination pixel averages the
+// source pixels it covers (box filter), which gives clean results when shrinking.
+func resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for y := 0; y < size; y++ {
+		sy0 := b.Min.Y + y*side/size
+		sy1 := max(b.Min.Y+(y+1)*side/size, sy0+1)
+		for x := 0; x < size; x++ {
+			sx0 := b.Min.X + x*side/size
+			sx1 := max(b.Min.X+(x+1)*side/size, sx0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			// Colors are premultiplied, so this composites transparent areas over white
+			// (JPEG has no alpha channel)
+			bg := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + bg),
+				G: uint16(g/n + bg),
+				B: uint16(bl/n + bg),
+				A: 0xffff,
+			})
+		}
+	}
+
+	return dst
+}
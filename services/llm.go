@@ -0,0 +1,183 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shogoshima/divertidachat-backend/models"
+)
+
+// LLMProvider generates the chat completions text filters rewrite messages with
+type LLMProvider interface {
+	// Complete answers the conversation with the model, the provider's default when empty
+	Complete(ctx context.Context, model string, messages []models.GPTMessage) (LLMCompletion, error)
+}
+
+// LLMCompletion is the answer of an LLMProvider
+type LLMCompletion struct {
+	Content     string
+	TotalTokens int // Prompt and completion, counted against the user's usage
+}
+
+var LLM LLMProvider
+
+const defaultLLMTimeout = 15 * time.Second
+
+// LLMFilterModels maps the IDs of system text filters to the model they use, when it
+// isn't the provider's default
+var LLMFilterModels = map[int]string{}
+
+// OpenAILLM talks to the chat completions API of OpenAI, or of any server compatible
+// with it (Ollama, llama.cpp...)
+type OpenAILLM struct {
+	BaseURL      string // e.g. https://api.openai.com/v1
+	APIKey       string // Optional for local servers
+	DefaultModel string
+	Client       *http.Client
+}
+
+func (p *OpenAILLM) Complete(ctx context.Context, model string, messages []models.GPTMessage) (LLMCompletion, error) {
+	if model == "" {
+		model = p.DefaultModel
+	}
+
+	requestBody, err := json.Marshal(models.GPTRequest{
+		Model:    model,
+		Messages: messages,
+	})
+	if err != nil {
+		return LLMCompletion{}, fmt.Errorf("failed to marshal GPT request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.BaseURL+"/chat/completions", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return LLMCompletion{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return LLMCompletion{}, classifyLLMTransportError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return LLMCompletion{}, classifyLLMTransportError(ctx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return LLMCompletion{}, classifyLLMResponse(resp, body)
+	}
+
+	var gptResponse models.GPTResponse
+	if err := json.Unmarshal(body, &gptResponse); err != nil {
+		return LLMCompletion{}, &LLMError{Kind: LLMBadRequest, Err: fmt.Errorf("failed to unmarshal GPT response: %w", err)}
+	}
+
+	if len(gptResponse.Choices) == 0 {
+		return LLMCompletion{}, &LLMError{Kind: LLMBadRequest, Err: fmt.Errorf("no choices returned from GPT")}
+	}
+
+	return LLMCompletion{
+		Content:     gptResponse.Choices[0].Message.Content,
+		TotalTokens: gptResponse.Usage.TotalTokens,
+	}, nil
+}
+
+// FakeLLM answers without any model, deterministically, for tests and local
+// development: with Reply when set, otherwise by echoing the last message. Tokens
+// are counted as words.
+type FakeLLM struct {
+	Reply func(model string, messages []models.GPTMessage) (string, error)
+}
+
+func (p *FakeLLM) Complete(ctx context.Context, model string, messages []models.GPTMessage) (LLMCompletion, error) {
+	var content string
+	if p.Reply != nil {
+		var err error
+		if content, err = p.Reply(model, messages); err != nil {
+			return LLMCompletion{}, err
+		}
+	} else if len(messages) > 0 {
+		content = messages[len(messages)-1].Content
+	}
+
+	tokens := len(strings.Fields(content))
+	for _, m := range messages {
+		tokens += len(strings.Fields(m.Content))
+	}
+	return LLMCompletion{Content: content, TotalTokens: tokens}, nil
+}
+
+// InitLLM configures the LLM provider from the environment: LLM_PROVIDER is "openai"
+// (the default, for any compatible server at LLM_BASE_URL) or "fake".
+// LLM_FILTER_MODELS picks models per system text filter ID, as "1=llama3,7=gpt-4o".
+// Each attempt is limited to LLM_TIMEOUT_SECONDS.
+func InitLLM() {
+	timeout := defaultLLMTimeout
+	if seconds, err := strconv.Atoi(os.Getenv("LLM_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	var provider LLMProvider
+	switch name := strings.ToLower(os.Getenv("LLM_PROVIDER")); name {
+	case "", "openai":
+		baseURL := os.Getenv("LLM_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		apiKey := os.Getenv("LLM_API_KEY")
+		if apiKey == "" {
+			apiKey = os.Getenv("OPENAI_API_KEY")
+		}
+		model := os.Getenv("LLM_MODEL")
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		provider = &OpenAILLM{
+			BaseURL:      strings.TrimSuffix(baseURL, "/"),
+			APIKey:       apiKey,
+			DefaultModel: model,
+			// A backstop: attempts have their own, shorter, deadline
+			Client: &http.Client{Timeout: 2 * timeout},
+		}
+	case "fake":
+		provider = &FakeLLM{}
+	default:
+		log.Fatalf("unknown LLM provider %q", name)
+	}
+
+	LLM = &ResilientLLM{
+		Provider:       provider,
+		Attempts:       3,
+		AttemptTimeout: timeout,
+		BaseDelay:      500 * time.Millisecond,
+		MaxDelay:       5 * time.Second,
+		Breaker:        &CircuitBreaker{Threshold: 5, Cooldown: 30 * time.Second},
+	}
+
+	for _, pair := range strings.Split(os.Getenv("LLM_FILTER_MODELS"), ",") {
+		id, model, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		filterID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			log.Fatalf("invalid text filter ID %q in LLM_FILTER_MODELS", id)
+		}
+		LLMFilterModels[filterID] = strings.TrimSpace(model)
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shogoshima/divertidachat-backend/models"
+)
+
+// Kinds of LLM failures
+type LLMErrorKind int
+
+const (
+	LLMUnavailable LLMErrorKind = iota // The server couldn't be reached
+	LLMTimeout                         // No answer before the deadline
+	LLMRateLimited                     // 429: too many requests or quota exhausted
+	LLMAuthFailed                      // 401 or 403: the API key is wrong
+	LLMServerError                     // 5xx
+	LLMBadRequest                      // Any other 4xx, or an answer we can't use
+)
+
+// LLMError is a classified failure of an LLM provider
+type LLMError struct {
+	Kind       LLMErrorKind
+	StatusCode int           // Of the HTTP response, if any
+	RetryAfter time.Duration // As asked by the server, if any
+	Err        error
+}
+
+func (e *LLMError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LLMError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether trying again later may succeed
+func (e *LLMError) Retryable() bool {
+	switch e.Kind {
+	case LLMUnavailable, LLMTimeout, LLMRateLimited, LLMServerError:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrLLMCircuitOpen is returned without calling the provider while it is considered down
+var ErrLLMCircuitOpen = errors.New("the LLM provider is unavailable")
+
+// classifyLLMResponse turns an unsuccessful HTTP response into an LLMError
+func classifyLLMResponse(resp *http.Response, body []byte) *LLMError {
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	e := &LLMError{
+		StatusCode: resp.StatusCode,
+		Err:        fmt.Errorf("the LLM answered %d: %s", resp.StatusCode, bytes.TrimSpace(body)),
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = LLMRateLimited
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		e.Kind = LLMAuthFailed
+	case resp.StatusCode >= 500:
+		e.Kind = LLMServerError
+	default:
+		e.Kind = LLMBadRequest
+	}
+	return e
+}
+
+// classifyLLMTransportError turns a failed HTTP request into an LLMError
+func classifyLLMTransportError(ctx context.Context, err error) *LLMError {
+	if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+		return &LLMError{Kind: LLMTimeout, Err: fmt.Errorf("the LLM didn't answer in time: %w", err)}
+	}
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &LLMError{Kind: LLMTimeout, Err: fmt.Errorf("the LLM didn't answer in time: %w", err)}
+	}
+	return &LLMError{Kind: LLMUnavailable, Err: fmt.Errorf("failed to call the LLM: %w", err)}
+}
+
+// ResilientLLM wraps a provider with a deadline per attempt, retries with exponential
+// backoff for the failures that may go away, and a circuit breaker so that calls fail
+// fast while the provider is down
+type ResilientLLM struct {
+	Provider       LLMProvider
+	Attempts       int
+	AttemptTimeout time.Duration
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	Breaker        *CircuitBreaker
+}
+
+func (r *ResilientLLM) Complete(ctx context.Context, model string, messages []models.GPTMessage) (LLMCompletion, error) {
+	if !r.Breaker.Allow() {
+		return LLMCompletion{}, ErrLLMCircuitOpen
+	}
+
+	var err error
+	for attempt := 0; attempt < r.Attempts; attempt++ {
+		if attempt > 0 {
+			delay := min(r.BaseDelay<<(attempt-1), r.MaxDelay)
+			delay += time.Duration(rand.Int63n(int64(delay/2) + 1))
+			var llmErr *LLMError
+			if errors.As(err, &llmErr) && llmErr.RetryAfter > delay {
+				delay = llmErr.RetryAfter
+			}
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				break // No time left for another attempt
+			}
+
+			select {
+			case <-ctx.Done():
+				r.Breaker.Record(err)
+				return LLMCompletion{}, err
+			case <-time.After(delay):
+			}
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, r.AttemptTimeout)
+		var completion LLMCompletion
+		completion, err = r.Provider.Complete(attemptCtx, model, messages)
+		cancel()
+		if err == nil {
+			r.Breaker.Record(nil)
+			return completion, nil
+		}
+
+		var llmErr *LLMError
+		if !errors.As(err, &llmErr) || !llmErr.Retryable() || ctx.Err() != nil {
+			break
+		}
+	}
+
+	r.Breaker.Record(err)
+	return LLMCompletion{}, err
+}
+
+// CircuitBreaker opens after Threshold consecutive failures of the provider being down,
+// rejecting calls for Cooldown. A single call is then let through: its success closes
+// the circuit again, its failure reopens it.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Allow reports whether a call can be made now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.Threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record counts the outcome of a call. Only failures meaning the provider is down
+// count: a bad request or a rate limit is an answer, so the provider is up.
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	var llmErr *LLMError
+	switch {
+	case err == nil:
+		b.failures = 0
+	case !errors.As(err, &llmErr):
+		// Not the provider's doing (e.g. the caller gave up)
+	case llmErr.Kind == LLMUnavailable || llmErr.Kind == LLMTimeout || llmErr.Kind == LLMServerError:
+		b.failures++
+		if b.failures >= b.Threshold {
+			b.openUntil = time.Now().Add(b.Cooldown)
+		}
+	default:
+		b.failures = 0
+	}
+}
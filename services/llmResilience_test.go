@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shogoshima/divertidachat-backend/models"
+)
+
+// flakyLLM answers with FakeLLM, failing with err while it is set
+func flakyLLM(err *error, calls *int) *FakeLLM {
+	return &FakeLLM{Reply: func(model string, messages []models.GPTMessage) (string, error) {
+		*calls++
+		if *err != nil {
+			return "", *err
+		}
+		return "ok", nil
+	}}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	down := error(&LLMError{Kind: LLMUnavailable, Err: errors.New("connection refused")})
+	calls := 0
+	llm := &ResilientLLM{
+		Provider:       flakyLLM(&down, &calls),
+		Attempts:       1,
+		AttemptTimeout: time.Second,
+		Breaker:        &CircuitBreaker{Threshold: 3, Cooldown: 50 * time.Millisecond},
+	}
+	messages := []models.GPTMessage{{Role: "user", Content: "hi"}}
+
+	// Closed: calls go through until the threshold is reached
+	for i := 0; i < 3; i++ {
+		if _, err := llm.Complete(context.Background(), "", messages); !errors.Is(err, down) {
+			t.Fatalf("call %d: err = %v, want the provider's", i, err)
+		}
+	}
+
+	// Open: calls fail fast without reaching the provider
+	if _, err := llm.Complete(context.Background(), "", messages); !errors.Is(err, ErrLLMCircuitOpen) {
+		t.Fatalf("err = %v with the circuit open, want ErrLLMCircuitOpen", err)
+	}
+	if calls != 3 {
+		t.Fatalf("provider called %d times, want 3", calls)
+	}
+
+	// Half open: after the cooldown, a failed probe reopens the circuit
+	time.Sleep(60 * time.Millisecond)
+	if _, err := llm.Complete(context.Background(), "", messages); !errors.Is(err, down) {
+		t.Fatalf("probe err = %v, want the provider's", err)
+	}
+	if _, err := llm.Complete(context.Background(), "", messages); !errors.Is(err, ErrLLMCircuitOpen) {
+		t.Fatalf("err = %v after a failed probe, want ErrLLMCircuitOpen", err)
+	}
+
+	// A successful probe closes it again
+	time.Sleep(60 * time.Millisecond)
+	down = nil
+	for i := 0; i < 2; i++ {
+		completion, err := llm.Complete(context.Background(), "", messages)
+		if err != nil || completion.Content != "ok" {
+			t.Fatalf("call %d after recovery = %q, %v", i, completion.Content, err)
+		}
+	}
+}
+
+func TestCircuitBreakerIgnoresAnswers(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute}
+	for i := 0; i < 5; i++ {
+		b.Record(&LLMError{Kind: LLMRateLimited, Err: errors.New("slow down")})
+		b.Record(&LLMError{Kind: LLMBadRequest, Err: errors.New("bad request")})
+		b.Record(context.Canceled)
+	}
+	if !b.Allow() {
+		t.Error("the circuit opened on failures that don't mean the provider is down")
+	}
+}
+
+func TestResilientLLMRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"server error", &LLMError{Kind: LLMServerError, Err: errors.New("502")}, 3},
+		{"rate limited", &LLMError{Kind: LLMRateLimited, Err: errors.New("429")}, 3},
+		{"bad request", &LLMError{Kind: LLMBadRequest, Err: errors.New("400")}, 1},
+		{"auth failed", &LLMError{Kind: LLMAuthFailed, Err: errors.New("401")}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err, calls := tt.err, 0
+			llm := &ResilientLLM{
+				Provider:       flakyLLM(&err, &calls),
+				Attempts:       3,
+				AttemptTimeout: time.Second,
+				BaseDelay:      time.Millisecond,
+				MaxDelay:       5 * time.Millisecond,
+				Breaker:        &CircuitBreaker{Threshold: 10, Cooldown: time.Minute},
+			}
+			if _, got := llm.Complete(context.Background(), "", nil); !errors.Is(got, tt.err) {
+				t.Errorf("err = %v, want %v", got, tt.err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
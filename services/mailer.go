@@ -0,0 +1,213 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email is a message sent to a single recipient, with plain text and HTML bodies
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+var Mail Mailer
+
+// SMTPMailer sends emails through an SMTP server, authenticating when Username is set.
+// From can include a display name ("Divertida Chat <no-reply@example.com>").
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// smtpTimeout bounds a delivery when the context has no deadline of its own
+const smtpTimeout = time.Minute
+
+func (m *SMTPMailer) Send(ctx context.Context, email Email) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	msg, err := buildEmail(m.From, email)
+	if err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(m.Host, m.Port))
+	if err != nil {
+		return fmt.Errorf("failed to connect to the SMTP server: %w", err)
+	}
+	// net/smtp has no timeouts of its own: the deadline covers the whole conversation
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start SMTP session: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	// The envelope only takes the bare address, the display name stays in the header
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := client.Rcpt(email.To); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return client.Quit()
+}
+
+// buildEmail renders the email as a multipart/alternative MIME message
+func buildEmail(from string, email Email) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, p.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", email.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// MemoryMailer records emails instead of sending them, for tests
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+// Sent returns the emails recorded so far
+func (m *MemoryMailer) Sent() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Email(nil), m.sent...)
+}
+
+// LogMailer writes the plain text of emails instead of sending them, for local
+// development without an SMTP server
+type LogMailer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{w: w}
+}
+
+func (m *LogMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "--- Email to %s: %s\n%s\n", email.To, email.Subject, email.Text)
+	return err
+}
+
+// InitMailer configures the mailer from the environment: MAILER is "smtp" to send
+// through SMTP_HOST, "log" (the default) to write emails to standard output, or
+// "memory" to only record them.
+func InitMailer() {
+	switch mailer := strings.ToLower(os.Getenv("MAILER")); mailer {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		Mail = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	case "", "log":
+		Mail = NewLogMailer(os.Stdout)
+	case "memory":
+		Mail = &MemoryMailer{}
+	default:
+		log.Fatalf("unknown mailer %q", mailer)
+	}
+}
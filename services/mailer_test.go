@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	m := &MemoryMailer{}
+	email := Email{To: "ana@example.com", Subject: "Hi", Text: "Hello", HTML: "<p>Hello</p>"}
+	if err := m.Send(context.Background(), email); err != nil {
+		t.Fatal(err)
+	}
+	if sent := m.Sent(); len(sent) != 1 || sent[0] != email {
+		t.Errorf("sent = %+v, want the email", sent)
+	}
+}
+
+func TestBuildEmail(t *testing.T) {
+	raw, err := buildEmail("Divertida Chat <no-reply@example.com>", Email{
+		To:      "ana@example.com",
+		Subject: "Você tem mensagens",
+		Text:    "Hello",
+		HTML:    "<p>Hello</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Você tem mensagens" {
+		t.Errorf("subject = %q", subject)
+	}
+	if from, err := msg.Header.AddressList("From"); err != nil || from[0].Address != "no-reply@example.com" {
+		t.Errorf("from = %v, %v", from, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type = %q, %v", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []string{"Hello", "<p>Hello</p>"} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := io.ReadAll(part); string(body) != want {
+			t.Errorf("part = %q, want %q", body, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Moderator checks content written by users (e.g. text filter prompts) against the
+// content policies
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (ModerationResult, error)
+}
+
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string // Why it was flagged
+}
+
+var Moderation Moderator
+
+// OpenAIModerator uses the moderation API of OpenAI
+type OpenAIModerator struct {
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+}
+
+func (m *OpenAIModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	requestBody, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return ModerationResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.BaseURL+"/moderations", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return ModerationResult{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.APIKey)
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return ModerationResult{}, classifyLLMTransportError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ModerationResult{}, classifyLLMTransportError(ctx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ModerationResult{}, classifyLLMResponse(resp, body)
+	}
+
+	var moderation struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &moderation); err != nil {
+		return ModerationResult{}, fmt.Errorf("failed to unmarshal moderation response: %w", err)
+	}
+
+	var result ModerationResult
+	for _, r := range moderation.Results {
+		result.Flagged = result.Flagged || r.Flagged
+		for category, flagged := range r.Categories {
+			if flagged {
+				result.Categories = append(result.Categories, category)
+			}
+		}
+	}
+	return result, nil
+}
+
+// WordListModerator flags content containing any of the blocked words, for tests and
+// local development. Without words, nothing is flagged.
+type WordListModerator struct {
+	Blocked []string
+}
+
+func (m *WordListModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	lower := strings.ToLower(text)
+	for _, word := range m.Blocked {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			return ModerationResult{Flagged: true, Categories: []string{"blocklist"}}, nil
+		}
+	}
+	return ModerationResult{}, nil
+}
+
+// InitModeration configures the moderator from the environment: MODERATION_PROVIDER
+// is "openai" (at MODERATION_BASE_URL), "wordlist" to block the words of
+// MODERATION_BLOCKLIST, or "none". Without it, OpenAI is used when an API key is
+// configured, the word list otherwise (e.g. local setups with LLM_PROVIDER=fake).
+func InitModeration() {
+	apiKey := os.Getenv("MODERATION_API_KEY")
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+
+	provider := strings.ToLower(os.Getenv("MODERATION_PROVIDER"))
+	if provider == "" {
+		provider = "wordlist"
+		if apiKey != "" && strings.ToLower(os.Getenv("LLM_PROVIDER")) != "fake" {
+			provider = "openai"
+		}
+	}
+
+	switch provider {
+	case "openai":
+		if apiKey == "" {
+			log.Fatalf("the openai moderation provider needs MODERATION_API_KEY or OPENAI_API_KEY")
+		}
+		baseURL := os.Getenv("MODERATION_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		Moderation = &OpenAIModerator{
+			BaseURL: strings.TrimSuffix(baseURL, "/"),
+			APIKey:  apiKey,
+			Client:  &http.Client{Timeout: 10 * time.Second},
+		}
+	case "wordlist":
+		Moderation = &WordListModerator{Blocked: strings.Split(os.Getenv("MODERATION_BLOCKLIST"), ",")}
+	case "none":
+		Moderation = &WordListModerator{}
+	default:
+		log.Fatalf("unknown moderation provider %q", provider)
+	}
+}
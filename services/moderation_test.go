@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWordListModerator(t *testing.T) {
+	m := &WordListModerator{Blocked: []string{"spam", "", "Scam"}}
+	tests := []struct {
+		text    string
+		flagged bool
+	}{
+		{"like a pirate", false},
+		{"buy SPAM now", true},
+		{"a scammer", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		result, err := m.Moderate(context.Background(), tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Flagged != tt.flagged {
+			t.Errorf("Moderate(%q) flagged = %v, want %v", tt.text, result.Flagged, tt.flagged)
+		}
+	}
+}
+
+func TestInitModerationDefaults(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiKey      string
+		llmProvider string
+		wantOpenAI  bool
+	}{
+		{"no key", "", "", false},
+		{"key", "sk-test", "", true},
+		{"fake LLM", "sk-test", "fake", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MODERATION_PROVIDER", "")
+			t.Setenv("MODERATION_API_KEY", "")
+			t.Setenv("OPENAI_API_KEY", tt.apiKey)
+			t.Setenv("LLM_PROVIDER", tt.llmProvider)
+
+			InitModeration()
+			if _, ok := Moderation.(*OpenAIModerator); ok != tt.wantOpenAI {
+				t.Errorf("moderator = %T, want OpenAI %v", Moderation, tt.wantOpenAI)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// PushProvider delivers push notifications to devices
+type PushProvider interface {
+	// Send delivers a message to the single device of msg.Token
+	Send(ctx context.Context, msg *messaging.Message) error
+	// SendMulticast delivers a message to every token of msg.Tokens, reporting the
+	// outcome of each token in the same order
+	SendMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+}
+
+var Push PushProvider
+
+// FCMPush delivers notifications through Firebase Cloud Messaging
+type FCMPush struct {
+	Client *messaging.Client
+}
+
+func (p *FCMPush) Send(ctx context.Context, msg *messaging.Message) error {
+	_, err := p.Client.Send(ctx, msg)
+	return err
+}
+
+func (p *FCMPush) SendMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return p.Client.SendEachForMulticast(ctx, msg)
+}
+
+// SentPush is a notification recorded by MemoryPush or written by LogPush, one per token
+type SentPush struct {
+	Token        string                  `json:"token"`
+	Notification *messaging.Notification `json:"notification,omitempty"`
+	Data         map[string]string       `json:"data,omitempty"`
+	SentAt       time.Time               `json:"sent_at"`
+}
+
+// MemoryPush records notifications instead of delivering them, for tests. Tokens
+// listed in Failures fail with the given error.
+type MemoryPush struct {
+	Failures map[string]error
+
+	mu   sync.Mutex
+	sent []SentPush
+}
+
+func (p *MemoryPush) Send(ctx context.Context, msg *messaging.Message) error {
+	return p.record(msg.Token, msg.Notification, msg.Data)
+}
+
+func (p *MemoryPush) SendMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return sendEach(msg, func(token string) error {
+		return p.record(token, msg.Notification, msg.Data)
+	}), nil
+}
+
+func (p *MemoryPush) record(token string, notification *messaging.Notification, data map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.Failures[token]; err != nil {
+		return err
+	}
+	p.sent = append(p.sent, SentPush{Token: token, Notification: notification, Data: data, SentAt: time.Now()})
+	return nil
+}
+
+// Sent returns the notifications recorded so far
+func (p *MemoryPush) Sent() []SentPush {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]SentPush(nil), p.sent...)
+}
+
+// Reset forgets the recorded notifications
+func (p *MemoryPush) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = nil
+}
+
+// LogPush writes notifications as JSON lines instead of delivering them, for local
+// development without Firebase credentials
+type LogPush struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewLogPush(w io.Writer) *LogPush {
+	return &LogPush{w: w}
+}
+
+func (p *LogPush) Send(ctx context.Context, msg *messaging.Message) error {
+	return p.write(msg.Token, msg.Notification, msg.Data)
+}
+
+func (p *LogPush) SendMulticast(ctx context.Context, msg *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return sendEach(msg, func(token string) error {
+		return p.write(token, msg.Notification, msg.Data)
+	}), nil
+}
+
+func (p *LogPush) write(token string, notification *messaging.Notification, data map[string]string) error {
+	line, err := json.Marshal(SentPush{Token: token, Notification: notification, Data: data, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.w.Write(append(line, '\n'))
+	return err
+}
+
+// sendEach builds the response of a multicast sent one token at a time
+func sendEach(msg *messaging.MulticastMessage, send func(token string) error) *messaging.BatchResponse {
+	response := &messaging.BatchResponse{Responses: make([]*messaging.SendResponse, len(msg.Tokens))}
+	for i, token := range msg.Tokens {
+		if err := send(token); err != nil {
+			response.Responses[i] = &messaging.SendResponse{Error: err}
+			response.FailureCount++
+			continue
+		}
+		response.Responses[i] = &messaging.SendResponse{Success: true, MessageID: fmt.Sprintf("fake-%d", time.Now().UnixNano())}
+		response.SuccessCount++
+	}
+	return response
+}
+
+// PushProviderName is the push provider chosen with PUSH_PROVIDER, "fcm" by default
+func PushProviderName() string {
+	if provider := strings.ToLower(os.Getenv("PUSH_PROVIDER")); provider != "" {
+		return provider
+	}
+	return "fcm"
+}
+
+// InitPush configures the push provider from the environment: PUSH_PROVIDER is
+// "fcm" (the default), "log" to write notifications to PUSH_LOG_FILE (or standard
+// output), or "memory" to only record them.
+func InitPush() {
+	switch provider := PushProviderName(); provider {
+	case "fcm":
+		if MessagingClient == nil {
+			log.Fatalf("the fcm push provider needs the Firebase messaging client")
+		}
+		Push = &FCMPush{Client: MessagingClient}
+	case "log":
+		var w io.Writer = os.Stdout
+		if path := os.Getenv("PUSH_LOG_FILE"); path != "" {
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				log.Fatalf("failed to open push log file: %v", err)
+			}
+			w = f
+		}
+		Push = NewLogPush(w)
+	case "memory":
+		Push = &MemoryPush{}
+	default:
+		log.Fatalf("unknown push provider %q", provider)
+	}
+}
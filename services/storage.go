@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage persists uploaded files (group photos, avatars...) and exposes them through a public URL
+type Storage interface {
+	// Put stores the content under key and returns the URL clients should use to fetch it
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error)
+	// Open reads back the content stored under key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the content stored under key, it is not an error if it doesn't exist
+	Delete(ctx context.Context, key string) error
+	// KeyFromURL returns the key of a URL returned by Put, and false for URLs this storage doesn't own
+	KeyFromURL(url string) (string, bool)
+}
+
+var FileStorage Storage
+
+// ExportStorage keeps account data exports. Unlike FileStorage it must not be served
+// publicly: exports are only downloaded through their expiring link.
+var ExportStorage Storage
+
+// LocalStorage keeps files on the local disk, to be served by the HTTP server under BaseURL
+type LocalStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) (string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	// Write to a temporary file first so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	return s.BaseURL + "/" + key, nil
+}
+
+func (s *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return f, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) KeyFromURL(url string) (string, bool) {
+	key, ok := strings.CutPrefix(url, s.BaseURL+"/")
+	if !ok || key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+// path resolves key inside Dir, refusing keys that would escape it
+func (s *LocalStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean("/" + key)
+	if cleaned == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, cleaned), nil
+}
+
+// InitStorage configures the storage backend from the environment
+func InitStorage() {
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "./uploads"
+	}
+
+	baseURL := os.Getenv("STORAGE_BASE_URL")
+	if baseURL == "" {
+		baseURL = "/uploads"
+	}
+
+	FileStorage = &LocalStorage{
+		Dir:     dir,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+
+	exportDir := os.Getenv("EXPORT_DIR")
+	if exportDir == "" {
+		exportDir = "./exports"
+	}
+
+	ExportStorage = &LocalStorage{Dir: exportDir}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"github.com/shogoshima/divertidachat-backend/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// systemTextFilters are the built-in text filters, available to everyone. Their IDs
+// are fixed: clients and stored settings refer to them.
+var systemTextFilters = []models.TextFilter{
+	{
+		ID:      1,
+		Name:    "Flirting",
+		Emoji:   "💘",
+		Command: "in a flirty manner",
+	},
+	{
+		ID:      2,
+		Name:    "Pirate",
+		Emoji:   "🏴‍☠️",
+		Command: "like a pirate",
+	},
+	{
+		ID:      3,
+		Name:    "Shakespeare",
+		Emoji:   "🧙‍♂️",
+		Command: "as if you were a Shakespearean character",
+	},
+	{
+		ID:      4,
+		Name:    "Glitch",
+		Emoji:   "💻",
+		Command: "with lots of typing errors",
+	},
+	{
+		ID:      5,
+		Name:    "Emoji",
+		Emoji:   "😀",
+		Command: "using only emojis",
+	},
+	{
+		ID:      6,
+		Name:    "Yoda",
+		Emoji:   "👽",
+		Command: "like Yoda",
+	},
+	{
+		ID:      7,
+		Name:    "Valley Girl",
+		Emoji:   "💅",
+		Command: "like a stereotypical valley girl, saying 'like' a lot",
+	},
+	{
+		ID:      8,
+		Name:    "Drama Queen",
+		Emoji:   "🎭",
+		Command: "in a dramatic and over-the-top way",
+	},
+	{
+		ID:      9,
+		Name:    "Detective Noir",
+		Emoji:   "🕵️‍♂️",
+		Command: "like a noir detective narrating a mystery",
+	},
+	{
+		ID:      10,
+		Name:    "Corporate Jargon",
+		Emoji:   "📊",
+		Command: "using only corporate business jargon",
+	},
+	{
+		ID:      11,
+		Name:    "Karen",
+		Emoji:   "🧍‍♀️",
+		Command: "like a person demanding to speak to the manager",
+	},
+	{
+		ID:      12,
+		Name:    "Minion",
+		Emoji:   "🍌",
+		Command: "like a minion from the Despicable Me movies",
+	},
+	{
+		ID:      13,
+		Name:    "Zen Master",
+		Emoji:   "🧘",
+		Command: "like a calm zen master sharing ancient wisdom",
+	},
+	{
+		ID:      14,
+		Name:    "Shrek",
+		Emoji:   "🧅",
+		Command: "like Shrek, using ogre slang and swamp metaphors",
+	},
+}
+
+// seedTextFilters creates or refreshes the system text filters, then moves the ID
+// sequence past them so user filters never take a system ID
+func seedTextFilters() error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		filters := make([]models.TextFilter, len(systemTextFilters))
+		copy(filters, systemTextFilters)
+		for i := range filters {
+			filters[i].Scope = models.TextFilterSystem
+		}
+
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "emoji", "command", "scope"}),
+		}).Create(&filters).Error; err != nil {
+			return err
+		}
+
+		return tx.Exec(`SELECT setval(pg_get_serial_sequence('text_filters', 'id'), GREATEST((SELECT MAX(id) FROM text_filters), 1))`).Error
+	})
+}